@@ -1,10 +1,13 @@
 package betterrest
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/inject"
 	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/betterrest/libs/utils/sqlbuilder"
 	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/registry"
 	"github.com/t2wu/betterrest/routes"
@@ -16,11 +19,39 @@ import (
 type Config struct {
 	Log           bool
 	TransactDebug bool
+
+	// TextSearchConfig is the Postgres text search config for ?q=, "simple" if not given.
+	// It must be an identifier (optionally schema qualified), SetConfig panics otherwise.
+	TextSearchConfig string
+
+	// LegacyLatestN keeps the deprecated latestn behavior (latestn without latestnon)
+	LegacyLatestN bool
+
+	// PreloadMaxDepth is how many levels of associations are loaded by ReadMany, 8 if not given
+	PreloadMaxDepth int
+
+	// NotifyChannel is the Postgres channel to NOTIFY committed writes on (see hook/notify), off if empty
+	NotifyChannel string
+
+	// Audit records every write with before/after snapshots in the better_rest_audit table
+	Audit bool
 }
 
 func SetConfig(cfg Config) {
 	settings.Log = cfg.Log
 	settings.TransactDebug = cfg.TransactDebug
+	settings.LegacyLatestN = cfg.LegacyLatestN
+	if cfg.TextSearchConfig != "" {
+		if !sqlbuilder.ValidTextSearchConfig(cfg.TextSearchConfig) {
+			panic(fmt.Sprintf("TextSearchConfig %q is not a valid text search config name", cfg.TextSearchConfig))
+		}
+		settings.TextSearchConfig = cfg.TextSearchConfig
+	}
+	if cfg.PreloadMaxDepth != 0 {
+		settings.PreloadMaxDepth = cfg.PreloadMaxDepth
+	}
+	settings.NotifyChannel = cfg.NotifyChannel
+	settings.Audit = cfg.Audit
 }
 
 /*
@@ -40,6 +71,18 @@ func RegisterContextFunction(f func(r *http.Request) mdlutil.UserIDFetchable) {
 	routes.WhoFromContext = f
 }
 
+// RegisterAuditAdminFunction registers who can read the audit log at GET /betterrest/audit
+func RegisterAuditAdminFunction(f func(who mdlutil.UserIDFetchable) bool) {
+	routes.IsAuditAdmin = f
+}
+
 var For func(typeString string) *registry.Registrar = registry.For
 
+// GlobalHook registers a hook for every model, like Hook() in For(...). Opt out with NoGlobalHook().
+var GlobalHook func(hdlr hook.IHook, method string, args ...interface{}) = registry.RegGlobalHook
+
+// Provide registers a service for the hook fields tagged betterrest:"inject" of its interface type,
+// e.g. Provide((*lockhandler.LockStore)(nil), &dbservice.Lock{})
+var Provide func(iface interface{}, svc interface{}) = inject.Provide
+
 var Sorter func(sorter hook.IRoleSorter) = registry.RegRoleSorter
@@ -0,0 +1,123 @@
+package datamapper
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+	"github.com/t2wu/betterrest/datamapper/gormfixes"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// auditSnapshots marshals the records before the write, since the task may modify them.
+// Nothing for create.
+func auditSnapshots(job batchOpJob) ([]*registry.RawJSON, error) {
+	var before []mdl.IModel
+	switch job.ep.Op {
+	case rest.OpCreate:
+		return nil, nil
+	case rest.OpUpdate, rest.OpPatch:
+		before = job.oldmodelObjs
+	default: // delete, restore and purge, the loaded records
+		before = job.modelObjs
+	}
+
+	snapshots := make([]*registry.RawJSON, len(job.modelObjs))
+	for i := range snapshots {
+		if i >= len(before) || before[i] == nil {
+			continue
+		}
+
+		var err error
+		if snapshots[i], err = toRawJSON(before[i]); err != nil {
+			return nil, err
+		}
+	}
+	return snapshots, nil
+}
+
+// writeAudit inserts an audit entry for each record written, in the same transaction
+func writeAudit(db *gorm.DB, ep *hook.EndPoint, before []*registry.RawJSON, ms []mdl.IModel) error {
+	entries := make([]interface{}, len(ms))
+	for i, m := range ms {
+		entry := &registry.BetterRESTAudit{
+			ID:         datatype.NewUUID(),
+			TypeString: ep.TypeString,
+			Op:         ep.Op,
+			URL:        ep.URL,
+		}
+		if ep.Who != nil {
+			entry.UserID = ep.Who.GetUserID()
+		}
+		if before != nil {
+			entry.Before = before[i]
+		}
+
+		if m != nil {
+			entry.ModelID = m.GetID()
+		}
+		if m != nil && ep.Op != rest.OpDelete && ep.Op != rest.OpPurge {
+			var err error
+			if entry.After, err = toRawJSON(m); err != nil {
+				return err
+			}
+		}
+
+		diff, err := auditDiff(entry.Before, entry.After)
+		if err != nil {
+			return err
+		}
+		entry.Diff = diff
+
+		entries[i] = entry
+	}
+
+	return gormfixes.BulkInsert(db.New(), "", entries)
+}
+
+// auditDiff has the top-level fields which differ between the two snapshots
+func auditDiff(before, after *registry.RawJSON) (registry.RawJSON, error) {
+	oldFields, newFields := make(map[string]interface{}), make(map[string]interface{})
+	if before != nil {
+		if err := json.Unmarshal([]byte(*before), &oldFields); err != nil {
+			return "", err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal([]byte(*after), &newFields); err != nil {
+			return "", err
+		}
+	}
+
+	type change struct {
+		Old interface{} `json:"old"`
+		New interface{} `json:"new"`
+	}
+	diff := make(map[string]change)
+	for k, v := range oldFields {
+		if v2, ok := newFields[k]; !ok || !reflect.DeepEqual(v, v2) {
+			diff[k] = change{Old: v, New: newFields[k]}
+		}
+	}
+	for k, v := range newFields {
+		if _, ok := oldFields[k]; !ok {
+			diff[k] = change{New: v}
+		}
+	}
+
+	b, err := json.Marshal(diff)
+	return registry.RawJSON(b), err
+}
+
+func toRawJSON(m mdl.IModel) (*registry.RawJSON, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	j := registry.RawJSON(b)
+	return &j, nil
+}
@@ -0,0 +1,25 @@
+package datamapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2wu/betterrest/registry"
+)
+
+func TestAuditDiff_OnlyChangedFields(t *testing.T) {
+	before := registry.RawJSON(`{"name": "front door", "schedule": "9-5", "floor": 1}`)
+	after := registry.RawJSON(`{"name": "front door", "schedule": "8-6", "floor": 1, "note": "x"}`)
+
+	diff, err := auditDiff(&before, &after)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"schedule": {"old": "9-5", "new": "8-6"}, "note": {"old": null, "new": "x"}}`, string(diff))
+}
+
+func TestAuditDiff_Delete(t *testing.T) {
+	before := registry.RawJSON(`{"name": "front door"}`)
+
+	diff, err := auditDiff(&before, nil)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name": {"old": "front door", "new": null}}`, string(diff))
+}
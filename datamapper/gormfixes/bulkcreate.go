@@ -0,0 +1,285 @@
+package gormfixes
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// maxBulkParams keeps a statement under Postgres' limit of 65535 parameters
+const maxBulkParams = 65000
+
+// CanBulkCreate tells if models of this type can be created with BulkCreateModelsAndPeg.
+// Only peg relations (has-many or has-one) are followed, models with pegassoc fields at any
+// level have to be created one by one.
+func CanBulkCreate(db *gorm.DB, modelObj mdl.IModel) bool {
+	return canBulkCreate(db, reflect.Indirect(reflect.ValueOf(modelObj)).Type(), make(map[reflect.Type]bool))
+}
+
+func canBulkCreate(db *gorm.DB, typ reflect.Type, visited map[reflect.Type]bool) bool {
+	if visited[typ] {
+		return true
+	}
+	visited[typ] = true
+
+	for _, field := range db.NewScope(reflect.New(typ).Interface()).GetModelStruct().StructFields {
+		switch pegPegassocOrPegManyToMany(field.Tag) {
+		case "":
+		case "peg":
+			rel := field.Relationship
+			if rel == nil || (rel.Kind != "has_many" && rel.Kind != "has_one") {
+				return false
+			}
+
+			elemTyp := field.Struct.Type
+			for elemTyp.Kind() == reflect.Slice || elemTyp.Kind() == reflect.Ptr {
+				elemTyp = elemTyp.Elem()
+			}
+			if !canBulkCreate(db, elemTyp, visited) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// BulkCreateModelsAndPeg creates the models with multi-row INSERTs, then their pegged models
+// the same way, one table at a time. The models all have to be of the same type.
+// Pegged models given an ID are checked not to exist already, as qry's Create does.
+func BulkCreateModelsAndPeg(db *gorm.DB, modelObjs []mdl.IModel) error {
+	if len(modelObjs) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(modelObjs))
+	for i, modelObj := range modelObjs {
+		values[i] = modelObj
+	}
+	if err := BulkInsert(db, "", values); err != nil {
+		return err
+	}
+
+	for _, field := range db.NewScope(modelObjs[0]).GetModelStruct().StructFields {
+		if pegPegassocOrPegManyToMany(field.Tag) != "peg" || field.Relationship == nil {
+			continue
+		}
+		rel := field.Relationship
+
+		children := make([]mdl.IModel, 0)
+		givenIDs := make([]interface{}, 0)
+		for _, modelObj := range modelObjs {
+			scope := db.NewScope(modelObj)
+			f, ok := scope.FieldByName(field.Name)
+			if !ok || f.IsBlank {
+				continue
+			}
+
+			for _, child := range loadedModelsToCreate(f.Field) {
+				if child.GetID() == nil {
+					child.SetID(datatype.NewUUID())
+				} else {
+					givenIDs = append(givenIDs, child.GetID().String())
+				}
+
+				// Point the foreign key to the parent
+				childScope := db.NewScope(child)
+				for k, fkName := range rel.ForeignFieldNames {
+					parentField, ok := scope.FieldByName(rel.AssociationForeignFieldNames[k])
+					if !ok {
+						return fmt.Errorf("field %s not found in %s", rel.AssociationForeignFieldNames[k], scope.TableName())
+					}
+					if err := childScope.SetColumn(fkName, parentField.Field.Interface()); err != nil {
+						return err
+					}
+				}
+
+				children = append(children, child)
+			}
+		}
+
+		if err := checkPeggedIDsAreNew(db, children, givenIDs); err != nil {
+			return err
+		}
+
+		if err := BulkCreateModelsAndPeg(db, children); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPeggedIDsAreNew is the check qry's Create does, pegged models can be given an ID but it
+// cannot be pre-existing (including a soft-deleted one)
+func checkPeggedIDsAreNew(db *gorm.DB, children []mdl.IModel, ids []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tableName := db.NewScope(children[0]).TableName()
+	var count int
+	if err := db.Unscoped().Table(tableName).Where(fmt.Sprintf("\"%s\".id IN (?)", tableName), ids).Count(&count).Error; err != nil {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("pegged %s cannot have a pre-existing ID", tableName)
+	}
+	return nil
+}
+
+// BulkInsert inserts values (pointers to structs of the same type) with multi-row INSERTs, and sets
+// them to what the database returns. Associations are not touched. tableName can be empty to use
+// the model's table. Like gorm's Create, BeforeSave/BeforeCreate and AfterCreate/AfterSave are called.
+// The clause of InsertOnConflictDoNothing is added for its table, ErrInsertConflict is returned if a row
+// isn't inserted because of it.
+func BulkInsert(db *gorm.DB, tableName string, values []interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	scope := db.NewScope(values[0])
+	if tableName == "" {
+		tableName = scope.TableName()
+	}
+
+	columns := make([]*gorm.StructField, 0)
+	for _, field := range scope.GetModelStruct().StructFields {
+		if field.IsNormal && !field.IsIgnored {
+			columns = append(columns, field)
+		}
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("no column to insert into %s", tableName)
+	}
+
+	now := gorm.NowFunc()
+	for _, value := range values {
+		s := db.NewScope(value)
+		s.CallMethod("BeforeSave")
+		s.CallMethod("BeforeCreate")
+		if s.HasError() {
+			return s.DB().Error
+		}
+
+		for _, name := range []string{"CreatedAt", "UpdatedAt"} {
+			if f, ok := s.FieldByName(name); ok && f.IsBlank {
+				if err := f.Set(now); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = scope.Quote(column.DBName)
+	}
+
+	rowsPerStmt := maxBulkParams / len(columns)
+	for start := 0; start < len(values); start += rowsPerStmt {
+		end := start + rowsPerStmt
+		if end > len(values) {
+			end = len(values)
+		}
+
+		if err := bulkInsertRows(db, scope.Quote(tableName), quotedColumns, columns, values[start:end], onConflictClause(db, tableName)); err != nil {
+			return err
+		}
+	}
+
+	for _, value := range values {
+		s := db.NewScope(value)
+		s.CallMethod("AfterCreate")
+		s.CallMethod("AfterSave")
+		if s.HasError() {
+			return s.DB().Error
+		}
+	}
+
+	return nil
+}
+
+func bulkInsertRows(db *gorm.DB, quotedTable string, quotedColumns []string, columns []*gorm.StructField,
+	values []interface{}, option string) error {
+	rowStmts := make([]string, len(values))
+	vars := make([]interface{}, 0, len(values)*len(columns))
+	byPrimaryKey := make(map[string]*gorm.Scope)
+	for i, value := range values {
+		s := db.NewScope(value)
+		byPrimaryKey[fmt.Sprint(s.PrimaryKeyValue())] = s
+
+		placeholders := make([]string, len(columns))
+		for j, column := range columns {
+			f, _ := s.FieldByName(column.Name)
+			if f.IsBlank && f.HasDefaultValue {
+				placeholders[j] = "DEFAULT" // let the database fill it, as gorm does by leaving it out
+			} else {
+				placeholders[j] = "?"
+				vars = append(vars, f.Field.Interface())
+			}
+		}
+		rowStmts[i] = "(" + strings.Join(placeholders, ",") + ")"
+	}
+
+	if option != "" {
+		option = " " + option
+	}
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s%s RETURNING *", quotedTable,
+		strings.Join(quotedColumns, ","), strings.Join(rowStmts, ","), option)
+
+	rows, err := db.Raw(stmt, vars...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// For table with trigger which update before insert, set the values back
+	typ := reflect.Indirect(reflect.ValueOf(values[0])).Type()
+	n := 0
+	for rows.Next() {
+		n++
+		returned := reflect.New(typ).Interface()
+		if err := db.ScanRows(rows, returned); err != nil {
+			return err
+		}
+
+		returnedScope := db.NewScope(returned)
+		s, ok := byPrimaryKey[fmt.Sprint(returnedScope.PrimaryKeyValue())]
+		if !ok {
+			continue
+		}
+		for _, column := range columns {
+			f, _ := s.FieldByName(column.Name)
+			rf, _ := returnedScope.FieldByName(column.Name)
+			if err := f.Set(rf.Field.Interface()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n != len(values) {
+		return ErrInsertConflict
+	}
+	return nil
+}
+
+// loadedModelsToCreate returns the models in a struct, pointer or slice field, whether they have
+// ID or not
+func loadedModelsToCreate(v reflect.Value) []mdl.IModel {
+	if v.Kind() == reflect.Struct {
+		if m, ok := v.Addr().Interface().(mdl.IModel); ok {
+			return []mdl.IModel{m}
+		}
+		return nil
+	}
+	return loadedModels(v)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/t2wu/qry/datatype"
@@ -29,6 +30,10 @@ type cargo struct {
 // DeleteModelFixManyToManyAndPeg remove nested field if it has tag \"betterrest="peg"\"
 // Pegassoc is no problem, because we never tried to take care of it
 // If necessary, DB foreign key constraint will do the job
+// With a scoped db (soft delete), pegged models with DeletedAt are soft-deleted as well, so they can be
+// restored together. Those without DeletedAt are deleted for real. Many-to-many link rows are always removed.
+// The defaults can be changed with onDelete in the tag, ApplyOnDeleteActions has to be called before
+// modelObj itself is deleted.
 func DeleteModelFixManyToManyAndPeg(db *gorm.DB, modelObj mdl.IModel) error {
 	if err := removeManyToManyAssociationTableElem(db, modelObj); err != nil {
 		return err
@@ -55,141 +60,97 @@ func DeleteModelFixManyToManyAndPeg(db *gorm.DB, modelObj mdl.IModel) error {
 	return nil
 }
 
-// TODO: if there is a "pegassoc-manytomany" inside a pegged struct
-// and we're deleting the pegged struct, the many-to-many relationship needs to be removed
+// markForDelete records the pegged models under v to be deleted, and removes the many-to-many
+// link rows of those pegged models along the way
 func markForDelete(db *gorm.DB, v reflect.Value, car cargo) error {
 	for i := 0; i < v.NumField(); i++ {
-		t := pegPegassocOrPegManyToMany(v.Type().Field(i).Tag)
-		if t == "peg" {
-			switch v.Field(i).Kind() {
-			case reflect.Struct:
-				m := v.Field(i).Addr().Interface().(mdl.IModel)
-				if m.GetID() != nil { // could be embedded struct that never get initialiezd
-					fieldTableName := mdl.GetTableNameFromIModel(m)
-					if _, ok := car.peg[fieldTableName]; ok {
-						mids := car.peg[fieldTableName]
-						mids.ids = append(mids.ids, m.GetID())
-						car.peg[fieldTableName] = mids
-					} else {
-						arr := make([]interface{}, 1)
-						arr[0] = m.GetID()
-						car.peg[fieldTableName] = modelAndIds{modelObj: m, ids: arr}
-					}
+		if !deletedWithParent(v.Type().Field(i).Tag) {
+			continue
+		}
 
-					// Traverse into it
-					if err := markForDelete(db, v.Field(i), car); err != nil {
-						return err
-					}
+		switch v.Field(i).Kind() {
+		case reflect.Struct:
+			m := v.Field(i).Addr().Interface().(mdl.IModel)
+			if m.GetID() != nil { // could be embedded struct that never get initialiezd
+				if err := markOneForDelete(db, m, car); err != nil {
+					return err
 				}
-			case reflect.Slice:
-				typ := v.Type().Field(i).Type.Elem()
-				m, _ := reflect.New(typ).Interface().(mdl.IModel)
-				fieldTableName := mdl.GetTableNameFromIModel(m)
-				for j := 0; j < v.Field(i).Len(); j++ {
-					if _, ok := car.peg[fieldTableName]; ok {
-						mids := car.peg[fieldTableName]
-						mids.ids = append(mids.ids, v.Field(i).Index(j).Addr().Interface().(mdl.IModel).GetID())
-						car.peg[fieldTableName] = mids
-					} else {
-						arr := make([]interface{}, 1)
-						arr[0] = v.Field(i).Index(j).Addr().Interface().(mdl.IModel).GetID()
-						car.peg[fieldTableName] = modelAndIds{modelObj: m, ids: arr}
-					}
 
-					// Can it be a pointer type inside?, then unbox it in the next recursion
-					if err := markForDelete(db, v.Field(i).Index(j), car); err != nil {
-						return err
-					}
+				// Traverse into it
+				if err := markForDelete(db, v.Field(i), car); err != nil {
+					return err
+				}
+			}
+		case reflect.Slice:
+			for j := 0; j < v.Field(i).Len(); j++ {
+				m := v.Field(i).Index(j).Addr().Interface().(mdl.IModel)
+				if err := markOneForDelete(db, m, car); err != nil {
+					return err
 				}
-			case reflect.Ptr:
-				// Need to dereference and get the struct id before traversing in
-				if !isNil(v.Field(i)) && !isNil(v.Field(i).Elem()) &&
-					v.Field(i).IsValid() && v.Field(i).Elem().IsValid() {
-					imodel := v.Field(i).Interface().(mdl.IModel)
-					fieldTableName := mdl.GetTableNameFromIModel(imodel)
-					id := v.Field(i).Interface().(mdl.IModel).GetID()
-
-					if _, ok := car.peg[fieldTableName]; ok {
-						mids := car.peg[fieldTableName]
-						mids.ids = append(mids.ids, id)
-						car.peg[fieldTableName] = mids
-					} else {
-						arr := make([]interface{}, 1)
-						arr[0] = id
-						car.peg[fieldTableName] = modelAndIds{modelObj: imodel, ids: arr}
-					}
 
-					if err := markForDelete(db, v.Field(i).Elem(), car); err != nil {
-						return err
-					}
+				// Can it be a pointer type inside?, then unbox it in the next recursion
+				if err := markForDelete(db, v.Field(i).Index(j), car); err != nil {
+					return err
 				}
 			}
-		} else if strings.HasPrefix(t, "pegassoc-manytomany") {
-			// We're deleting. And now we have a many to many in here
-			// Remove the many to many
-			var m mdl.IModel
-			switch v.Field(i).Kind() {
-			case reflect.Struct:
-				m = v.Field(i).Addr().Interface().(mdl.IModel)
-			case reflect.Slice:
-				typ := v.Type().Field(i).Type.Elem()
-				m = reflect.New(typ).Interface().(mdl.IModel)
-			case reflect.Ptr:
-				m = v.Elem().Interface().(mdl.IModel)
-			}
-			if err := removeManyToManyAssociationTableElem(db, m); err != nil {
-				return err
+		case reflect.Ptr:
+			// Need to dereference and get the struct id before traversing in
+			if !isNil(v.Field(i)) && !isNil(v.Field(i).Elem()) &&
+				v.Field(i).IsValid() && v.Field(i).Elem().IsValid() {
+				if err := markOneForDelete(db, v.Field(i).Interface().(mdl.IModel), car); err != nil {
+					return err
+				}
+
+				if err := markForDelete(db, v.Field(i).Elem(), car); err != nil {
+					return err
+				}
 			}
 		}
 	}
 	return nil
 }
 
+func markOneForDelete(db *gorm.DB, m mdl.IModel, car cargo) error {
+	fieldTableName := mdl.GetTableNameFromIModel(m)
+	if mids, ok := car.peg[fieldTableName]; ok {
+		mids.ids = append(mids.ids, m.GetID())
+		car.peg[fieldTableName] = mids
+	} else {
+		// A new instance with no ID, otherwise Gorm adds its ID to the WHERE clause when deleting
+		zero := reflect.New(reflect.Indirect(reflect.ValueOf(m)).Type()).Interface().(mdl.IModel)
+		car.peg[fieldTableName] = modelAndIds{modelObj: zero, ids: []interface{}{m.GetID()}}
+	}
+
+	// The pegged model is going away, so are its many-to-many links
+	return removeManyToManyAssociationTableElem(db, m)
+}
+
 func isNil(a interface{}) bool {
 	defer func() { recover() }()
 	return a == nil || reflect.ValueOf(a).IsNil()
 }
 
+// removeManyToManyAssociationTableElem removes all the link rows of modelObj in the link tables
+// of its pegassoc-manytomany fields, whether the other side is loaded (or soft-deleted) or not.
+// The models on the other side are not deleted.
 func removeManyToManyAssociationTableElem(db *gorm.DB, modelObj mdl.IModel) error {
-	// many to many, here we remove the entry in the actual immediate table
-	// because that's actually the link table. Thought we don't delete the
-	// Model table itself
+	if modelObj.GetID() == nil {
+		return nil
+	}
+
 	v := reflect.Indirect(reflect.ValueOf(modelObj))
 	for i := 0; i < v.NumField(); i++ {
-		tag := v.Type().Field(i).Tag.Get("betterrest")
+		tag := pegPegassocOrPegManyToMany(v.Type().Field(i).Tag)
 		if strings.HasPrefix(tag, "pegassoc-manytomany") {
-			// many to many, here we remove the entry in the actual immediate table
-			// because that's actually the link table. Thought we don't delete the
-			// Model table itself
-
 			// The normal Delete(model, ids) doesn't quite work because
 			// I don't have access to the model, it's not registered as typestring
 			// nor part of the field type. It's a joining table between many to many
-
 			linkTableName := strings.Split(tag, ":")[1]
-			typ := v.Type().Field(i).Type.Elem() // Get the type of the element of slice
-			m2, _ := reflect.New(typ).Interface().(mdl.IModel)
-			fieldTableName := mdl.GetTableNameFromIModel(m2)
 			selfTableName := mdl.GetTableNameFromIModel(modelObj)
 
-			fieldVal := v.Field(i)
-			if fieldVal.Len() >= 1 {
-				uuidStmts := strings.Repeat("?,", fieldVal.Len())
-				uuidStmts = uuidStmts[:len(uuidStmts)-1]
-
-				allIds := make([]interface{}, 0, 10)
-				allIds = append(allIds, modelObj.GetID().String())
-				for j := 0; j < fieldVal.Len(); j++ {
-					idToDel := fieldVal.Index(j).FieldByName("ID").Interface().(*datatype.UUID)
-					allIds = append(allIds, idToDel.String())
-				}
-
-				stmt := fmt.Sprintf("DELETE FROM \"%s\" WHERE \"%s\" = ? AND \"%s\" IN (%s)",
-					linkTableName, selfTableName+"_id", fieldTableName+"_id", uuidStmts)
-				err := db.Exec(stmt, allIds...).Error
-				if err != nil {
-					return err
-				}
+			stmt := fmt.Sprintf("DELETE FROM \"%s\" WHERE \"%s\" = ?", linkTableName, selfTableName+"_id")
+			if err := db.Exec(stmt, modelObj.GetID().String()).Error; err != nil {
+				return err
 			}
 		}
 	}
@@ -209,7 +170,7 @@ func pegPegassocOrPegManyToMany(tag reflect.StructTag) string {
 func CreatePeggedAssocFields(db *gorm.DB, modelObj mdl.IModel) (err error) {
 	v := reflect.Indirect(reflect.ValueOf(modelObj))
 	for i := 0; i < v.NumField(); i++ {
-		tag := v.Type().Field(i).Tag.Get("betterrest")
+		tag := pegPegassocOrPegManyToMany(v.Type().Field(i).Tag)
 		// columnName := v.Type().Field(i).Name
 		if tag == "pegassoc" {
 			fieldVal := v.Field(i)
@@ -258,7 +219,7 @@ func UpdatePeggedFields(db *gorm.DB, oldModelObj mdl.IModel, newModelObj mdl.IMo
 	v2 := reflect.Indirect(reflect.ValueOf(newModelObj))
 
 	for i := 0; i < v1.NumField(); i++ {
-		tag := v1.Type().Field(i).Tag.Get("betterrest")
+		tag := pegPegassocOrPegManyToMany(v1.Type().Field(i).Tag)
 
 		// fmt.Println("v1.Type().Field(i):", v1.Type().Field(i))
 
@@ -303,6 +264,9 @@ func UpdatePeggedFields(db *gorm.DB, oldModelObj mdl.IModel, newModelObj mdl.IMo
 					modelToDel := oriM[uuid]
 
 					if tag == "peg" {
+						if err := ApplyOnDeleteActions(db, modelToDel.(mdl.IModel)); err != nil {
+							return err
+						}
 						if err := db.Delete(modelToDel).Error; err != nil {
 							return err
 						}
@@ -415,7 +379,7 @@ func FixManyToMany(correctModel mdl.IModel, incorrectModel mdl.IModel) (err erro
 	v2 := reflect.Indirect(reflect.ValueOf(incorrectModel))
 
 	for i := 0; i < v1.NumField(); i++ {
-		tag := v1.Type().Field(i).Tag.Get("betterrest")
+		tag := pegPegassocOrPegManyToMany(v1.Type().Field(i).Tag)
 		// log.Println("tag:", tag)
 		if strings.HasPrefix(tag, "pegassoc-manytomany") {
 			v2.Field(i).Set(v1.Field(i))
@@ -430,7 +394,7 @@ func LoadManyToManyBecauseGormFailsWithID(db *gorm.DB, modelObj mdl.IModel) erro
 	v1 := reflect.Indirect(reflect.ValueOf(modelObj))
 
 	for i := 0; i < v1.NumField(); i++ {
-		tag := v1.Type().Field(i).Tag.Get("betterrest")
+		tag := pegPegassocOrPegManyToMany(v1.Type().Field(i).Tag)
 
 		if strings.HasPrefix(tag, "pegassoc-manytomany") {
 			tableName := mdl.GetTableNameFromIModel(reflect.ValueOf(modelObj).Interface().(mdl.IModel))
@@ -469,3 +433,229 @@ func LoadManyToManyBecauseGormFailsWithID(db *gorm.DB, modelObj mdl.IModel) erro
 	}
 	return nil
 }
+
+// RestoreModelAndPeg un-deletes a soft-deleted model and the pegged records under it.
+// Pegged records are found by their foreign keys because Gorm doesn't preload soft-deleted records.
+// Only those deleted together with (or after) the model are restored, not ones removed earlier by an update.
+// Many-to-many links are removed on delete, so they're not restored.
+func RestoreModelAndPeg(db *gorm.DB, modelObj mdl.IModel) error {
+	deletedAt := DeletedAt(modelObj)
+	if deletedAt == nil {
+		return nil // not deleted
+	}
+
+	db = db.Unscoped()
+	if err := db.Model(modelObj).UpdateColumn("deleted_at", nil).Error; err != nil {
+		return err
+	}
+
+	return restorePegged(db, modelObj, []interface{}{modelObj.GetID()}, *deletedAt)
+}
+
+// SoftDeletable tells if the model has DeletedAt, so Gorm soft-deletes it
+func SoftDeletable(modelObj mdl.IModel) bool {
+	_, ok := reflect.Indirect(reflect.ValueOf(modelObj)).Type().FieldByName("DeletedAt")
+	return ok
+}
+
+// DeletedAt returns when the model was soft-deleted, nil if it's not
+func DeletedAt(modelObj mdl.IModel) *time.Time {
+	v := reflect.Indirect(reflect.ValueOf(modelObj)).FieldByName("DeletedAt")
+	if !v.IsValid() {
+		return nil
+	}
+	deletedAt, _ := v.Interface().(*time.Time)
+	return deletedAt
+}
+
+// restorePegged restores the pegged records of modelObj's type whose parents are ids
+func restorePegged(db *gorm.DB, modelObj mdl.IModel, ids []interface{}, deletedAt time.Time) error {
+	for _, field := range db.NewScope(modelObj).Fields() {
+		rel := field.Relationship
+		if pegPegassocOrPegManyToMany(field.Tag) != "peg" || rel == nil || len(rel.ForeignDBNames) == 0 ||
+			(rel.Kind != "has_many" && rel.Kind != "has_one") {
+			continue
+		}
+
+		typ := field.Struct.Type
+		for typ.Kind() == reflect.Slice || typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		child, ok := reflect.New(typ).Interface().(mdl.IModel)
+		if !ok {
+			continue
+		}
+
+		tableName := mdl.GetTableNameFromIModel(child)
+		where := fmt.Sprintf("\"%s\".\"%s\" IN (?) AND \"%s\".\"deleted_at\" >= ?", tableName, rel.ForeignDBNames[0], tableName)
+
+		childIDs := make([]datatype.UUID, 0)
+		if err := db.Table(tableName).Where(where, ids, deletedAt).Pluck("id", &childIDs).Error; err != nil {
+			return err
+		}
+		if len(childIDs) == 0 {
+			continue
+		}
+
+		if err := db.Table(tableName).Where("id IN (?)", childIDs).UpdateColumn("deleted_at", nil).Error; err != nil {
+			return err
+		}
+
+		ids2 := make([]interface{}, len(childIDs))
+		for i := range childIDs {
+			ids2[i] = &childIDs[i]
+		}
+		if err := restorePegged(db, child, ids2, deletedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Referential actions in the betterrest tag, e.g. betterrest:"peg;onDelete:restrict"
+const (
+	OnDeleteRestrict = "restrict" // the parent cannot be deleted while there is any record, 409
+	OnDeleteCascade  = "cascade"  // records are deleted with the parent, default for peg
+	OnDeleteSetNull  = "setnull"  // foreign keys of the records are set to NULL
+)
+
+// DeleteRestrictedError is returned when deleting a parent which still has records under an onDelete:restrict relation
+type DeleteRestrictedError struct {
+	Model string // table of the parent
+	Field string // field with the restrict relation
+}
+
+func (e *DeleteRestrictedError) Error() string {
+	return fmt.Sprintf("cannot delete %s, there are still records in %s", e.Model, e.Field)
+}
+
+// OnDeleteAction returns the onDelete action in the betterrest tag, "" if not given
+func OnDeleteAction(tag reflect.StructTag) string {
+	for _, pair := range strings.Split(tag.Get("betterrest"), ";") {
+		if strings.HasPrefix(pair, "onDelete:") {
+			return strings.TrimPrefix(pair, "onDelete:")
+		}
+	}
+	return ""
+}
+
+// deletedWithParent tells if records under the field are deleted together with the parent
+func deletedWithParent(tag reflect.StructTag) bool {
+	action := OnDeleteAction(tag)
+	switch pegPegassocOrPegManyToMany(tag) {
+	case "peg":
+		return action == "" || action == OnDeleteCascade
+	case "pegassoc":
+		return action == OnDeleteCascade
+	}
+	return false
+}
+
+// ApplyOnDeleteActions checks onDelete:restrict and carries out onDelete:setnull on modelObj, and on the
+// pegged models going away with it. Call it before modelObj is deleted, so nothing is deleted when
+// a restrict relation still has records and the foreign keys are cleared before the parent row goes.
+func ApplyOnDeleteActions(db *gorm.DB, modelObj mdl.IModel) error {
+	if modelObj.GetID() == nil {
+		return nil
+	}
+
+	for _, field := range db.NewScope(modelObj).Fields() {
+		rel := pegPegassocOrPegManyToMany(field.Tag)
+		if rel == "" {
+			continue
+		}
+
+		switch OnDeleteAction(field.Tag) {
+		case OnDeleteRestrict:
+			n, err := countRelated(db, modelObj, field, rel)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return &DeleteRestrictedError{Model: mdl.GetTableNameFromIModel(modelObj), Field: field.Name}
+			}
+		case OnDeleteSetNull:
+			if field.Relationship == nil || len(field.Relationship.ForeignDBNames) == 0 {
+				continue // many-to-many link rows are removed anyway
+			}
+			tableName := mdl.GetTableNameFromIModel(relatedModel(field))
+			column := field.Relationship.ForeignDBNames[0]
+			if err := db.Table(tableName).Where(fmt.Sprintf("\"%s\".\"%s\" = ?", tableName, column), modelObj.GetID()).
+				UpdateColumn(column, nil).Error; err != nil {
+				return err
+			}
+		}
+
+		if !deletedWithParent(field.Tag) {
+			continue
+		}
+
+		// Records going away with the parent can have their own onDelete
+		for _, m := range loadedModels(field.Field) {
+			if err := ApplyOnDeleteActions(db, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// countRelated counts the records under the relation, whether they're loaded or not
+func countRelated(db *gorm.DB, modelObj mdl.IModel, field *gorm.Field, rel string) (int, error) {
+	n := 0
+	if strings.HasPrefix(rel, "pegassoc-manytomany") {
+		linkTableName := strings.Split(rel, ":")[1]
+		selfColumn := mdl.GetTableNameFromIModel(modelObj) + "_id"
+		err := db.Table(linkTableName).Where(fmt.Sprintf("\"%s\" = ?", selfColumn), modelObj.GetID()).Count(&n).Error
+		return n, err
+	}
+
+	if field.Relationship == nil || len(field.Relationship.ForeignDBNames) == 0 {
+		return 0, nil // belongs-to, the record doesn't depend on the parent
+	}
+
+	related := relatedModel(field)
+	tableName := mdl.GetTableNameFromIModel(related)
+	q := db.Table(tableName).Where(fmt.Sprintf("\"%s\".\"%s\" = ?", tableName, field.Relationship.ForeignDBNames[0]), modelObj.GetID())
+	if SoftDeletable(related) {
+		q = q.Where(fmt.Sprintf("\"%s\".\"deleted_at\" IS NULL", tableName))
+	}
+	err := q.Count(&n).Error
+	return n, err
+}
+
+// relatedModel returns a new instance of the model type of the field
+func relatedModel(field *gorm.Field) mdl.IModel {
+	typ := field.Struct.Type
+	for typ.Kind() == reflect.Slice || typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	m, _ := reflect.New(typ).Interface().(mdl.IModel)
+	return m
+}
+
+// loadedModels returns the models in a struct, pointer or slice field
+func loadedModels(v reflect.Value) []mdl.IModel {
+	ms := make([]mdl.IModel, 0)
+	switch v.Kind() {
+	case reflect.Struct:
+		if m, ok := v.Addr().Interface().(mdl.IModel); ok && m.GetID() != nil {
+			ms = append(ms, m)
+		}
+	case reflect.Ptr:
+		if !isNil(v.Interface()) {
+			if m, ok := v.Interface().(mdl.IModel); ok {
+				ms = append(ms, m)
+			}
+		}
+	case reflect.Slice:
+		for j := 0; j < v.Len(); j++ {
+			if m, ok := v.Index(j).Addr().Interface().(mdl.IModel); ok {
+				ms = append(ms, m)
+			}
+		}
+	}
+	return ms
+}
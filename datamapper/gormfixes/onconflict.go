@@ -0,0 +1,51 @@
+package gormfixes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrInsertConflict is returned when a row isn't inserted because of InsertOnConflictDoNothing.
+// Gorm's Create returns sql.ErrNoRows instead.
+var ErrInsertConflict = errors.New("a record with the same key already exists")
+
+const keyOnConflict = "betterrest:on_conflict"
+
+type onConflict struct {
+	tableName string
+	clause    string
+}
+
+func init() {
+	gorm.DefaultCallback.Create().Before("gorm:create").Register("betterrest:on_conflict", onConflictCallback)
+}
+
+// InsertOnConflictDoNothing returns db which inserts into tableName with ON CONFLICT (columns) DO NOTHING,
+// with Create or BulkInsert. Unlike setting gorm:insert_option, it's not used for the associations
+// Gorm creates along with it, like the ownership or pegged records. columns are quoted already.
+func InsertOnConflictDoNothing(db *gorm.DB, tableName string, columns []string) *gorm.DB {
+	clause := fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(columns, ","))
+	return db.Set(keyOnConflict, onConflict{tableName: tableName, clause: clause})
+}
+
+// onConflictCallback sets gorm:insert_option for the table of InsertOnConflictDoNothing, and clears it
+// for others since the setting is copied to the DB creating the associations
+func onConflictCallback(scope *gorm.Scope) {
+	if _, ok := scope.Get(keyOnConflict); !ok {
+		return
+	}
+
+	scope.Set("gorm:insert_option", onConflictClause(scope.DB(), scope.TableName()))
+}
+
+func onConflictClause(db *gorm.DB, tableName string) string {
+	if v, ok := db.Get(keyOnConflict); ok {
+		if c, ok := v.(onConflict); ok && c.tableName == tableName {
+			return c.clause
+		}
+	}
+	return ""
+}
@@ -3,8 +3,10 @@ package hfetcher
 import (
 	"reflect"
 	"runtime/debug"
+	"sort"
 
 	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/inject"
 	"github.com/t2wu/betterrest/hook/rest"
 	"github.com/t2wu/betterrest/registry/handlermap"
 )
@@ -36,7 +38,7 @@ type HandlerFetcher struct {
 // FetchHandlersForOpAndHook fetches the releveant hook for this method and hookstr.
 // If there is any hook whose first hookstr is this one, instantiate it.
 // If there are already instantiated hook which handles this hookstr, fetch it as well.
-// hookstr can be JBCATR (C is cache)
+// hookstr can be JBCQATR (C is cache, Q is before query)
 func (h *HandlerFetcher) FetchHandlersForOpAndHook(op rest.Op, hookstr string) []hook.IHook {
 	// Make sure it's only used for one hookstr
 	if h.op != rest.OpOther && h.op != op {
@@ -59,12 +61,19 @@ func (h *HandlerFetcher) FetchHandlersForOpAndHook(op rest.Op, hookstr string) [
 		method = "P"
 	case rest.OpDelete:
 		method = "D"
+	case rest.OpRestore:
+		method = "S"
+	case rest.OpPurge:
+		method = "X"
 	}
 
 	// Fetch new handlers and instantiate them if any
 	newHandlerTypeAndArgIfAny := h.handlerMap.GetHandlerTypeAndArgWithFirstHookAt(method, hookstr)
 	for _, newHandlerTypeAndArg := range newHandlerTypeAndArgIfAny {
 		newHandler := reflect.New(newHandlerTypeAndArg.HandlerType).Interface().(hook.IHook)
+		if err := inject.Into(newHandler); err != nil {
+			panic(err) // registry.CheckInjection should've caught it at startup
+		}
 		newHandler.Init(h.initData, newHandlerTypeAndArg.Args...) // dependency injection with h.args
 		h.handlers = append(h.handlers, newHandler)               // add to all handlers
 	}
@@ -79,6 +88,9 @@ func (h *HandlerFetcher) FetchHandlersForOpAndHook(op rest.Op, hookstr string) [
 		if _, ok := handler.(hook.ICache); ok && hookstr == "C" {
 			comformedHandlers = append(comformedHandlers, handler)
 		}
+		if _, ok := handler.(hook.IBeforeQuery); ok && hookstr == "Q" {
+			comformedHandlers = append(comformedHandlers, handler)
+		}
 		if _, ok := handler.(hook.IBefore); ok && hookstr == "B" {
 			comformedHandlers = append(comformedHandlers, handler)
 		}
@@ -93,6 +105,12 @@ func (h *HandlerFetcher) FetchHandlersForOpAndHook(op rest.Op, hookstr string) [
 		}
 	}
 
+	// Handlers instantiated at an earlier hook would otherwise come first
+	sort.SliceStable(comformedHandlers, func(i, j int) bool {
+		return h.handlerMap.Rank(reflect.TypeOf(comformedHandlers[i]).Elem()) <
+			h.handlerMap.Rank(reflect.TypeOf(comformedHandlers[j]).Elem())
+	})
+
 	return comformedHandlers
 }
 
@@ -107,3 +125,8 @@ func (h *HandlerFetcher) FetchHandlersForOpAndHook(op rest.Op, hookstr string) [
 func (h *HandlerFetcher) GetAllInstantiatedHanders() []hook.IHook {
 	return h.handlers
 }
+
+// Op is the op the handlers are fetched for, rest.OpOther if nothing is fetched yet
+func (h *HandlerFetcher) Op() rest.Op {
+	return h.op
+}
@@ -239,3 +239,21 @@ func TestHandlerFetcher_ShouldCallInit(t *testing.T) {
 		assert.True(t, handlers[0].(*HandlerBAT).initCalled)
 	}
 }
+
+func TestHandlerFetcher_HandlersAreInRankOrder(t *testing.T) {
+	handlerMap := handlermap.NewHandlerMap()
+	handlerMap.RegisterHandler(&HandlerAT{}, "C")
+	handlerMap.RegisterHandler(&HandlerBAT{}, "C", hook.RunAfter(&HandlerAT{}))
+
+	fetcher := NewHandlerFetcher(handlerMap, nil)
+	assert.Len(t, fetcher.FetchHandlersForOpAndHook(rest.OpCreate, "B"), 1)
+
+	// HandlerBAT is instantiated first but runs after
+	handlers := fetcher.FetchHandlersForOpAndHook(rest.OpCreate, "A")
+	if assert.Len(t, handlers, 2) {
+		_, ok := handlers[0].(*HandlerAT)
+		assert.True(t, ok)
+		_, ok = handlers[1].(*HandlerBAT)
+		assert.True(t, ok)
+	}
+}
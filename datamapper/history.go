@@ -0,0 +1,96 @@
+package datamapper
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// ErrNoHistory is returned when history is asked for but the audit log is off
+var ErrNoHistory = errors.New("history is not recorded, audit is off")
+
+// ErrHistoryNotAvailable is returned by ReadAsOf for a time before the history of the record starts,
+// when it was written before the audit log was on
+var ErrHistoryNotAvailable = errors.New("history of the record is not available that far back")
+
+// Version is a record as it was after a write, from the audit log
+type Version struct {
+	At     time.Time
+	Op     rest.Op
+	UserID *datatype.UUID
+	Model  mdl.IModel // nil if it was deleted
+}
+
+// ReadVersions returns the versions of a record, oldest first
+func ReadVersions(db *gorm.DB, typeString string, id *datatype.UUID) ([]Version, error) {
+	if !settings.Audit {
+		return nil, ErrNoHistory
+	}
+
+	entries := make([]registry.BetterRESTAudit, 0)
+	if err := db.Where("type_string = ? AND model_id = ?", typeString, id).
+		Order("created_at ASC").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, len(entries))
+	for i, entry := range entries {
+		modelObj, err := modelFromSnapshot(typeString, entry.After)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = Version{At: entry.CreatedAt, Op: entry.Op, UserID: entry.UserID, Model: modelObj}
+	}
+	return versions, nil
+}
+
+// ReadAsOf returns the record as it was at the given time. It's gorm.ErrRecordNotFound
+// if the record didn't exist then, and ErrHistoryNotAvailable if it was written before the
+// audit log was on and at is before its first audit entry (or it has none).
+func ReadAsOf(db *gorm.DB, typeString string, id *datatype.UUID, at time.Time) (mdl.IModel, error) {
+	if !settings.Audit {
+		return nil, ErrNoHistory
+	}
+
+	entry := registry.BetterRESTAudit{}
+	err := db.Where("type_string = ? AND model_id = ? AND created_at <= ?", typeString, id, at).
+		Order("created_at DESC").First(&entry).Error
+	if gorm.IsRecordNotFoundError(err) {
+		// Didn't exist yet if the history starts with its create, otherwise it's from before the audit
+		first := registry.BetterRESTAudit{}
+		if err := db.Where("type_string = ? AND model_id = ?", typeString, id).
+			Order("created_at ASC").First(&first).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+		if first.Op == rest.OpCreate {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return nil, ErrHistoryNotAvailable
+	} else if err != nil {
+		return nil, err
+	}
+
+	if entry.After == nil { // deleted by then
+		return nil, gorm.ErrRecordNotFound
+	}
+	return modelFromSnapshot(typeString, entry.After)
+}
+
+func modelFromSnapshot(typeString string, snapshot *registry.RawJSON) (mdl.IModel, error) {
+	if snapshot == nil {
+		return nil, nil
+	}
+
+	modelObj := registry.NewFromTypeString(typeString)
+	if err := json.Unmarshal([]byte(*snapshot), modelObj); err != nil {
+		return nil, err
+	}
+	return modelObj, nil
+}
@@ -0,0 +1,50 @@
+package datamapper
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/qry/datatype"
+)
+
+func newHistoryMock(firstOp rest.Op) (*gorm.DB, sqlmock.Sqlmock) {
+	sqldb, mock, _ := sqlmock.New()
+	db, _ := gorm.Open("postgres", sqldb)
+	db.SingularTable(true)
+
+	// nothing at or before asOf
+	stmt := `WHERE (type_string = $1 AND model_id = $2 AND created_at <= $3) ORDER BY created_at DESC`
+	mock.ExpectQuery(regexp.QuoteMeta(stmt)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	// the first entry of the record
+	stmt2 := `WHERE (type_string = $1 AND model_id = $2) ORDER BY created_at ASC`
+	mock.ExpectQuery(regexp.QuoteMeta(stmt2)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "op"}).AddRow(datatype.NewUUID(), firstOp))
+	return db, mock
+}
+
+func TestReadAsOf_WhenBeforeCreate_NotFound(t *testing.T) {
+	settings.Audit = true
+	defer func() { settings.Audit = false }()
+
+	db, mock := newHistoryMock(rest.OpCreate)
+	_, err := ReadAsOf(db, "trucks", datatype.NewUUID(), time.Now().Add(-time.Hour))
+	assert.True(t, gorm.IsRecordNotFoundError(err))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestReadAsOf_WhenBeforeTheAuditLogWasOn_HistoryNotAvailable(t *testing.T) {
+	settings.Audit = true
+	defer func() { settings.Audit = false }()
+
+	db, mock := newHistoryMock(rest.OpUpdate) // created before the audit
+	_, err := ReadAsOf(db, "trucks", datatype.NewUUID(), time.Now().Add(-time.Hour))
+	assert.Equal(t, ErrHistoryNotAvailable, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
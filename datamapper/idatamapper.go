@@ -13,10 +13,17 @@ import (
 
 type MapperRet struct {
 	Ms      []mdl.IModel // if for cardinality 1, only contains one element
+	OldMs   []mdl.IModel // before the write, see hook.Data
 	Roles   []userrole.UserRole
 	Fetcher *hfetcher.HandlerFetcher
 }
 
+// DistinctValue is one distinct value of a field and how many records have it
+type DistinctValue struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
 // IDataMapper has all the crud interfaces
 type IDataMapper interface {
 	// CreateMany(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
@@ -27,6 +34,9 @@ type IDataMapper interface {
 
 	ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, userrole.UserRole, *webrender.RetError)
 
+	// ReadDistinct counts the distinct values of a field among the records ReadMany would return
+	ReadDistinct(db *gorm.DB, field string, ep *hook.EndPoint, cargo *hook.Cargo) ([]DistinctValue, *webrender.RetError)
+
 	// UpdateMany(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
 
 	// UpdateOne(db *gorm.DB, modelObj mdl.IModel, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
@@ -39,6 +49,14 @@ type IDataMapper interface {
 
 	DeleteOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
 
+	// RestoreOne un-deletes a soft-deleted record, PurgeOne hard-deletes it
+	RestoreOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
+	PurgeOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
+
+	// ModelsExist tells which of the models exist among the records the user can access (and which of
+	// those are soft-deleted), for upsert
+	ModelsExist(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint) ([]bool, []bool, *webrender.RetError)
+
 	// The new one, since endpoints other than read and delete are not necessary to differentiate between two endpoints
 	Create(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError)
 	// ReadMany(db *gorm.DB, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, []userrole.UserRole, *int, *webrender.RetError)
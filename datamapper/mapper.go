@@ -14,6 +14,7 @@ import (
 	"github.com/t2wu/betterrest/hook/userrole"
 	"github.com/t2wu/betterrest/libs/urlparam"
 	"github.com/t2wu/betterrest/libs/utils/letters"
+	"github.com/t2wu/betterrest/libs/utils/sqlbuilder"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/model/mappertype"
@@ -68,6 +69,8 @@ func (mapper *DataMapper) Create(db *gorm.DB, modelObjs []mdl.IModel,
 		fetcher: hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData),
 		data:    data,
 		ep:      ep,
+
+		bulkTaskFunc: bulkCreateTask(mapper.Service, db, modelObjs),
 	}
 	return batchOpCore(j, mapper.Service.CreateOneCore)
 }
@@ -124,7 +127,23 @@ func (mapper *DataMapper) Create(db *gorm.DB, modelObjs []mdl.IModel,
 
 func (mapper *DataMapper) ReadMany(db *gorm.DB, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, []userrole.UserRole, *int, *webrender.RetError) {
 	dbClean := db
-	db = db.Set("gorm:auto_preload", true)
+	db = db.Set("gorm:auto_preload", false) // loaded by AssociationLoader after the query
+
+	if err := checkQueryFields(ep.TypeString, ep.URLParams); err != nil {
+		return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+	if retErr := checkRoleQueryFields(dbClean, ep.Who, ep.TypeString, ep.URLParams); retErr != nil {
+		return nil, nil, nil, retErr
+	}
+
+	loader, err := associationLoader(dbClean, ep.TypeString, ep.URLParams, service.AssociationLoader{})
+	if err != nil {
+		return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	if urlparam.GetIncludeDeleted(ep.URLParams) {
+		db = includeDeletedOfAdmin(db, ep.TypeString)
+	}
 
 	initData := hook.InitData{Roles: nil, Ep: ep}
 	fetcher := hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData)
@@ -150,38 +169,50 @@ func (mapper *DataMapper) ReadMany(db *gorm.DB, ep *hook.EndPoint, cargo *hook.C
 		}
 	}
 
-	offset, limit, cstart, cstop, orderby, order, latestn, latestnons, totalcount := urlparam.GetOptions(ep.URLParams)
+	offset, limit, cstart, cstop, orderby, order, _, _, totalcount := urlparam.GetOptions(ep.URLParams)
 	rtable := registry.GetTableNameFromTypeString(ep.TypeString)
 
 	if cstart != nil && cstop != nil {
 		db = db.Where(rtable+`.created_at BETWEEN ? AND ?`, time.Unix(int64(*cstart), 0), time.Unix(int64(*cstop), 0))
 	}
 
+	if ranges := urlparam.GetTimeRanges(ep.URLParams); len(ranges) != 0 {
+		var err error
+		db, err = constructTimeRangeQueries(db, ep.TypeString, rtable, ranges)
+		if err != nil {
+			return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+	}
+
+	search := urlparam.GetSearch(ep.URLParams)
+	if search != nil {
+		var err error
+		db, err = sqlbuilder.AddFullTextSearchStmt(db, ep.TypeString, rtable, *search)
+		if err != nil {
+			return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+	}
+
 	if cacheMiss {
 		var err error
 		var builder *qry.PredicateRelationBuilder
-		if latestn != nil { // query module currently don't handle latestn, use old if so
-			db, err = constructInnerFieldParamQueries(db, ep.TypeString, ep.URLParams, latestn, latestnons)
-			if err != nil {
-				return nil, nil, nil, &webrender.RetError{Error: err}
-			}
-		} else {
-			if urlParams, ok := ep.URLParams[urlparam.ParamOtherQueries].(url.Values); ok && len(urlParams) != 0 {
-				builder, err = createBuilderFromQueryParameters(urlParams, ep.TypeString)
-				if err != nil {
-					return nil, nil, nil, &webrender.RetError{Error: err}
-				}
-			}
+		var retErr *webrender.RetError
+		db, builder, retErr = constructFilterQueries(db, ep.TypeString, rtable, ep.URLParams)
+		if retErr != nil {
+			return nil, nil, nil, retErr
 		}
 
-		db, err = constructOrderFieldQueries(db, ep.TypeString, rtable, orderby, order)
-		if err != nil {
-			return nil, nil, nil, &webrender.RetError{Error: err}
+		if db, retErr = constructOrderFieldQueries(db, ep.TypeString, rtable, orderby, order, search); retErr != nil {
+			return nil, nil, nil, retErr
 		}
 		db, err = mapper.Service.GetAllQueryContructCore(db, ep.Who, ep.TypeString)
 		if err != nil {
 			return nil, nil, nil, &webrender.RetError{Error: err}
 		}
+		db = constructOnlyIDsQuery(db, rtable, ep.URLParams)
+		if db, retErr = beforeQuery(fetcher, db, ep); retErr != nil {
+			return nil, nil, nil, retErr
+		}
 
 		if totalcount {
 			no = new(int)
@@ -232,10 +263,9 @@ func (mapper *DataMapper) ReadMany(db *gorm.DB, ep *hook.EndPoint, cargo *hook.C
 			return nil, nil, nil, &webrender.RetError{Error: errors.New("unknown query error")}
 		}
 
-		// make many to many tag works
-		for _, m := range outmodels {
-			err = gormfixes.LoadManyToManyBecauseGormFailsWithID(dbClean, m)
-			if err != nil {
+		// Associations (many to many tags included) for all records, level by level
+		if loader != nil {
+			if err := loader.Load(dbClean, outmodels); err != nil {
 				return nil, nil, nil, &webrender.RetError{Error: err}
 			}
 		}
@@ -314,6 +344,10 @@ func (mapper *DataMapper) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPo
 	}
 
 	if cacheMiss {
+		if urlparam.GetIncludeDeleted(ep.URLParams) {
+			db = db.Unscoped().Set(service.KeyIncludeDeleted, true)
+		}
+
 		// anyone permission can read as long as you are linked on db
 		modelObj, role, err = loadAndCheckErrorBeforeModifyV2(mapper.Service, db, ep.Who, ep.TypeString, nil, id, []userrole.UserRole{userrole.UserRoleAny}, ep.URLParams)
 		var found bool = true
@@ -322,6 +356,18 @@ func (mapper *DataMapper) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPo
 				return nil, userrole.UserRoleInvalid, &webrender.RetError{Error: err}
 			}
 			found = false
+		} else if gormfixes.DeletedAt(modelObj) != nil && role != userrole.UserRoleAdmin { // only admin can see deleted ones
+			err = gorm.ErrRecordNotFound
+			found = false
+		}
+		if found {
+			var retErr *webrender.RetError
+			if found, retErr = beforeQueryAllowsOne(fetcher, db, ep, id); retErr != nil {
+				return nil, userrole.UserRoleInvalid, retErr
+			}
+			if !found {
+				err = gorm.ErrRecordNotFound
+			}
 		}
 
 		// Add to cache if hook defined
@@ -364,6 +410,11 @@ func (mapper *DataMapper) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPo
 	return &ret, role, nil
 }
 
+// ReadDistinct counts the distinct values of a field, e.g. GET /locks/distinct/model
+func (mapper *DataMapper) ReadDistinct(db *gorm.DB, field string, ep *hook.EndPoint, cargo *hook.Cargo) ([]DistinctValue, *webrender.RetError) {
+	return readDistinctCore(mapper.Service, db, field, ep)
+}
+
 // // UpdateOne updates model based on this json
 // func (mapper *DataMapper) UpdateOne(db *gorm.DB, modelObj mdl.IModel, id *datatype.UUID,
 // 	ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
@@ -725,6 +776,27 @@ func (mapper *DataMapper) DeleteOne(db *gorm.DB, id *datatype.UUID, ep *hook.End
 	return batchOpCore(j, mapper.Service.DeleteOneCore)
 }
 
+// RestoreOne un-deletes a soft-deleted record
+func (mapper *DataMapper) RestoreOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint,
+	cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	return restoreOneCore(mapper.Service, mapper.MapperType, db, id, ep, cargo)
+}
+
+// ModelsExist tells which of the models exist among the records the user can access, for upsert
+func (mapper *DataMapper) ModelsExist(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint) ([]bool, []bool, *webrender.RetError) {
+	exists, deleted, err := modelsExistCore(mapper.Service, db, ep.Who, ep.TypeString, modelObjs)
+	if err != nil {
+		return nil, nil, &webrender.RetError{Error: err}
+	}
+	return exists, deleted, nil
+}
+
+// PurgeOne hard-deletes a soft-deleted record
+func (mapper *DataMapper) PurgeOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint,
+	cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	return purgeOneCore(mapper.Service, mapper.MapperType, db, id, ep, cargo)
+}
+
 // DeleteMany deletes multiple mdl
 func (mapper *DataMapper) DeleteMany(db *gorm.DB, modelObjs []mdl.IModel,
 	ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
@@ -806,12 +878,25 @@ func (mapper *DataMapper) sortOldModelAndRolesByIds(oldModelObjs []mdl.IModel, r
 	return oldModelObjSorted, rolesSorted
 }
 
-func constructOrderFieldQueries(db *gorm.DB, typeString string, tableName string, orderby *string, order *string) (*gorm.DB, error) {
+func constructOrderFieldQueries(db *gorm.DB, typeString string, tableName string, orderby *string, order *string, search *string) (*gorm.DB, *webrender.RetError) {
+	// orderby=relevance ranks the full-text search result
+	if orderby != nil && *orderby == "relevance" {
+		if search == nil {
+			err := errors.New("orderby relevance should be used with q")
+			return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+		db, err := sqlbuilder.AddFullTextRankOrder(db, typeString, tableName, *search, order != nil && *order == "asc")
+		if err != nil {
+			return nil, &webrender.RetError{Error: err}
+		}
+		return db, nil
+	}
+
 	if orderby != nil {
 		modelObj := registry.NewFromTypeString(typeString)
 		// Make sure orderby is within the field
 		if _, err := datatype.GetModelFieldTypeIfValid(modelObj, letters.CamelCaseToPascalCase(*orderby)); err != nil {
-			return nil, err
+			return nil, &webrender.RetError{Error: err}
 		}
 	}
 
@@ -834,7 +919,10 @@ func createBuilderFromQueryParameters(urlParams url.Values, typeString string) (
 		model := registry.NewFromTypeString(typeString)
 		fieldName, err := mdl.JSONKeysToFieldName(model, urlQueryKey)
 		if err != nil {
-			continue // field name doesn't exists
+			if registry.ModelRegistry[typeString].CustomURLParams[urlQueryKey] {
+				continue // not a field, read by hooks
+			}
+			return nil, fmt.Errorf("%s is not a field which can be queried", urlQueryKey)
 		}
 
 		// urlQueryKeys can be the same, or can be different field
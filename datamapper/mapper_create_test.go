@@ -167,24 +167,13 @@ func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenGiven_GotCars() {
 	}
 
 	suite.mock.ExpectBegin()
-	// Gorm v1 insert 3 times
-	// (Also Gorm v2 support modifying returning: https://gorm.io/docs/update.html#Returning-Data-From-Modified-Rows
-	stmt1 := `INSERT INTO "car" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5) RETURNING "car"."id"`
-	stmt2 := `INSERT INTO "user_owns_car" ("id","created_at","updated_at","deleted_at","role","user_id","model_id") VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "user_owns_car"."id"`
-	stmt3 := `SELECT * FROM "car" WHERE "car"."deleted_at" IS NULL AND "car"."id" = $1 LIMIT 1`
-
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID1))
-	// actually it might not be possible to fetch the id gorm gives
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID1))
-
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID2))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID2))
-
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID3))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID3))
+	// One multi-row insert for the cars and one for the ownership rows
+	stmt1 := `INSERT INTO "car" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5),($6,$7,$8,$9,$10),($11,$12,$13,$14,$15) RETURNING *`
+	stmt2 := `INSERT INTO "user_owns_car" ("id","created_at","updated_at","deleted_at","role","user_id","model_id") VALUES ($1,$2,$3,$4,$5,$6,$7),($8,$9,$10,$11,$12,$13,$14),($15,$16,$17,$18,$19,$20,$21) RETURNING *`
+
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+		AddRow(carID1, carName1).AddRow(carID2, carName2).AddRow(carID3, carName3))
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(ownershipRows(suite.who, carID1, carID2, carID3))
 	suite.mock.ExpectCommit()
 
 	options := make(map[urlparam.Param]interface{})
@@ -218,6 +207,7 @@ func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenGiven_GotCars() {
 		assert.Equal(suite.T(), carName2, retVal.Ms[1].(*Car).Name)
 		assert.Equal(suite.T(), carName3, retVal.Ms[2].(*Car).Name)
 	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
 }
 
 func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenHavingController_CallRelevantControllerCallbacks() {
@@ -234,24 +224,13 @@ func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenHavingController_Call
 	}
 
 	suite.mock.ExpectBegin()
-	// Gorm v1 insert 3 times
-	// (Also Gorm v2 support modifying returning: https://gorm.io/docs/update.html#Returning-Data-From-Modified-Rows
-	stmt1 := `INSERT INTO "car" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5) RETURNING "car"."id"`
-	stmt2 := `INSERT INTO "user_owns_car" ("id","created_at","updated_at","deleted_at","role","user_id","model_id") VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "user_owns_car"."id"`
-	stmt3 := `SELECT * FROM "car" WHERE "car"."deleted_at" IS NULL AND "car"."id" = $1 LIMIT 1`
-
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID1))
-	// actually it might not be possible to fetch the id gorm gives
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID1))
-
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID2))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID2))
-
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID3))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
-	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(carID3))
+	// One multi-row insert for the cars and one for the ownership rows
+	stmt1 := `INSERT INTO "car" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5),($6,$7,$8,$9,$10),($11,$12,$13,$14,$15) RETURNING *`
+	stmt2 := `INSERT INTO "user_owns_car" ("id","created_at","updated_at","deleted_at","role","user_id","model_id") VALUES ($1,$2,$3,$4,$5,$6,$7),($8,$9,$10,$11,$12,$13,$14),($15,$16,$17,$18,$19,$20,$21) RETURNING *`
+
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+		AddRow(carID1, carName1).AddRow(carID2, carName2).AddRow(carID3, carName3))
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(ownershipRows(suite.who, carID1, carID2, carID3))
 	suite.mock.ExpectCommit()
 
 	options := make(map[urlparam.Param]interface{})
@@ -310,6 +289,121 @@ func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenHavingController_Call
 	}
 }
 
+func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenPegged_BulkInsertsChildrenWithParentID() {
+	dockID1, dockID2 := datatype.NewUUID(), datatype.NewUUID()
+	boatID1, boatID2, boatID3 := datatype.NewUUID(), datatype.NewUUID(), datatype.NewUUID()
+	delete(registry.ModelRegistry, "docks")
+
+	suite.mock.ExpectBegin()
+	stmt1 := `INSERT INTO "dock" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5),($6,$7,$8,$9,$10) RETURNING *`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+		AddRow(dockID1, "Pier 39").AddRow(dockID2, "Pier 45"))
+	// Given pegged IDs cannot be pre-existing
+	stmtCount := `SELECT count(*) FROM "boat"  WHERE ("boat".id IN ($1,$2,$3))`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmtCount)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	// All boats of both docks in one insert
+	stmt2 := `INSERT INTO "boat" ("id","created_at","updated_at","deleted_at","name","dock_id") VALUES ($1,$2,$3,$4,$5,$6),($7,$8,$9,$10,$11,$12),($13,$14,$15,$16,$17,$18) RETURNING *`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).
+		WithArgs(boatID1, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "Dinghy", dockID1,
+			boatID2, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "Kayak", dockID1,
+			boatID3, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "Yacht", dockID2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "dock_id"}).
+			AddRow(boatID1, "Dinghy", dockID1).AddRow(boatID2, "Kayak", dockID1).AddRow(boatID3, "Yacht (renamed by trigger)", dockID2))
+	stmt3 := `INSERT INTO "user_owns_dock" ("id","created_at","updated_at","deleted_at","role","user_id","model_id") VALUES ($1,$2,$3,$4,$5,$6,$7),($8,$9,$10,$11,$12,$13,$14) RETURNING *`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(ownershipRows(suite.who, dockID1, dockID2))
+	suite.mock.ExpectCommit()
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For("docks").ModelWithOption(&Dock{}, opt)
+
+	modelObjs := []mdl.IModel{
+		&Dock{BaseModel: mdl.BaseModel{ID: dockID1}, Name: "Pier 39", Boats: []Boat{
+			{BaseModel: mdl.BaseModel{ID: boatID1}, Name: "Dinghy"},
+			{BaseModel: mdl.BaseModel{ID: boatID2}, Name: "Kayak"},
+		}},
+		&Dock{BaseModel: mdl.BaseModel{ID: dockID2}, Name: "Pier 45", Boats: []Boat{
+			{BaseModel: mdl.BaseModel{ID: boatID3}, Name: "Yacht"},
+		}},
+	}
+
+	mapper := SharedOwnershipMapper()
+	ep := hook.EndPoint{
+		Op:          rest.OpCreate,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  "docks",
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	var retVal *MapperRet
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		retVal, retErr = mapper.Create(tx, modelObjs, &ep, &hook.Cargo{})
+		return retErr
+	}, "lifecycle.CreateMany")
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	if assert.Len(suite.T(), retVal.Ms, 2) {
+		dock1, dock2 := retVal.Ms[0].(*Dock), retVal.Ms[1].(*Dock)
+		assert.Equal(suite.T(), dockID1.String(), dock1.Boats[1].DockID.String())
+		assert.Equal(suite.T(), dockID2.String(), dock2.Boats[0].DockID.String())
+		assert.Equal(suite.T(), "Yacht (renamed by trigger)", dock2.Boats[0].Name)
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperCreateSuite) TestCreateMany_WhenPeggedIDExists_GotErrorBeforeInsertingIt() {
+	dockID1, dockID2 := datatype.NewUUID(), datatype.NewUUID()
+	boatID := datatype.NewUUID()
+	delete(registry.ModelRegistry, "docks")
+
+	suite.mock.ExpectBegin()
+	stmt1 := `INSERT INTO "dock" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5),($6,$7,$8,$9,$10) RETURNING *`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+		AddRow(dockID1, "Pier 39").AddRow(dockID2, "Pier 45"))
+	stmt2 := `SELECT count(*) FROM "boat"  WHERE ("boat".id IN ($1))`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WithArgs(boatID.String()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	// No INSERT INTO "boat"
+	suite.mock.ExpectRollback()
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For("docks").ModelWithOption(&Dock{}, opt)
+
+	modelObjs := []mdl.IModel{
+		&Dock{BaseModel: mdl.BaseModel{ID: dockID1}, Name: "Pier 39", Boats: []Boat{{BaseModel: mdl.BaseModel{ID: boatID}, Name: "Dinghy"}}},
+		&Dock{BaseModel: mdl.BaseModel{ID: dockID2}, Name: "Pier 45"},
+	}
+
+	mapper := SharedOwnershipMapper()
+	ep := hook.EndPoint{
+		Op:          rest.OpCreate,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  "docks",
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		_, retErr = mapper.Create(tx, modelObjs, &ep, &hook.Cargo{})
+		return retErr
+	}, "lifecycle.CreateMany")
+
+	if assert.NotNil(suite.T(), retErr) {
+		assert.Contains(suite.T(), retErr.Error.Error(), "pre-existing")
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+// ownershipRows is what the multi-row insert of admin ownership rows returns. Link IDs are
+// generated by the insert, so they don't match and aren't copied back.
+func ownershipRows(who mdlutil.UserIDFetchable, modelIDs ...*datatype.UUID) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "role", "user_id", "model_id"})
+	for _, modelID := range modelIDs {
+		rows.AddRow(datatype.NewUUID(), userrole.UserRoleAdmin, who.GetUserID(), modelID)
+	}
+	return rows
+}
+
 func dataComparison(expected *hook.Data, actual *hook.Data) func() (success bool) {
 	return func() (success bool) {
 		if expected.DB != actual.DB {
@@ -1,6 +1,7 @@
 package datamapper
 
 import (
+	"net/http"
 	"regexp"
 	"testing"
 
@@ -335,6 +336,68 @@ func (suite *TestBaseMapperDeleteSuite) TestDeleteMany_WhenHavingController_Call
 	}
 }
 
+// Dock can't be deleted while it has boats
+type Dock struct {
+	mdl.BaseModel
+
+	Name  string `json:"name"`
+	Boats []Boat `json:"boats" betterrest:"peg;onDelete:restrict"`
+
+	Ownerships []mdlutil.OwnershipModelWithIDBase `gorm:"PRELOAD:false" json:"-" betterrest:"ownership"`
+}
+
+type Boat struct {
+	mdl.BaseModel
+
+	Name   string         `json:"name"`
+	DockID *datatype.UUID `json:"dockID"`
+}
+
+func (suite *TestBaseMapperDeleteSuite) TestDeleteOne_WhenRestrictedRelationHasRecords_Got409BeforeDeleting() {
+	dockID := datatype.NewUUID()
+	boatID := datatype.NewUUID()
+	delete(registry.ModelRegistry, "docks")
+
+	suite.mock.ExpectBegin()
+	stmt := `SELECT "dock".* FROM "dock" INNER JOIN "user_owns_dock" ON "dock".id = "user_owns_dock".model_id AND "dock".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_dock".user_id AND "user_owns_dock".user_id = $2 WHERE "dock"."deleted_at" IS NULL`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(dockID, "Pier 39"))
+	stmt2 := `SELECT * FROM "boat"  WHERE "boat"."deleted_at" IS NULL AND (("dock_id" IN ($1)))`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "dock_id"}).AddRow(boatID, "Dinghy", dockID))
+	stmt3 := `SELECT "user_owns_dock"."role" FROM "dock" INNER JOIN "user_owns_dock" ON "dock".id = "user_owns_dock".model_id AND "dock".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_dock".user_id AND "user_owns_dock".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleAdmin))
+	stmt4 := `DELETE FROM user_owns_dock WHERE model_id = $1`
+	suite.mock.ExpectExec(regexp.QuoteMeta(stmt4)).WillReturnResult(sqlmock.NewResult(0, 1))
+	stmt5 := `SELECT count(*) FROM "boat"  WHERE ("boat"."dock_id" = $1) AND ("boat"."deleted_at" IS NULL)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt5)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	// No DELETE FROM "dock"
+	suite.mock.ExpectRollback()
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For("docks").ModelWithOption(&Dock{}, opt)
+
+	mapper := SharedOwnershipMapper()
+	ep := hook.EndPoint{
+		Op:          rest.OpDelete,
+		Cardinality: rest.CardinalityOne,
+		TypeString:  "docks",
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		_, retErr = mapper.DeleteOne(tx, dockID, &ep, &hook.Cargo{})
+		return retErr
+	}, "lifecycle.DeleteOne")
+
+	if !assert.NotNil(suite.T(), retErr) {
+		return
+	}
+	if renderer, ok := retErr.Renderer.(*webrender.ErrDeleteRestricted); assert.True(suite.T(), ok) {
+		assert.Equal(suite.T(), http.StatusConflict, renderer.HTTPStatusCode)
+	}
+	assert.Contains(suite.T(), retErr.Error.Error(), "Boats")
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
 func TestBaseMappingDeleteSuite(t *testing.T) {
 	suite.Run(t, new(TestBaseMapperDeleteSuite))
 }
@@ -1,6 +1,7 @@
 package datamapper
 
 import (
+	"net/url"
 	"regexp"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/t2wu/betterrest/hook/rest"
 	"github.com/t2wu/betterrest/hook/userrole"
 	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/model/mappertype"
 	"github.com/t2wu/betterrest/registry"
@@ -184,6 +186,7 @@ func (suite *TestBaseMapperReadSuite) TestReadMany_WhenGiven_GotCars() {
 		assert.Equal(suite.T(), carName2, retVal.Ms[1].(*Car).Name)
 		assert.Equal(suite.T(), carName3, retVal.Ms[2].(*Car).Name)
 	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
 }
 
 func (suite *TestBaseMapperReadSuite) TestReadMany_WhenHavingController_CallRelevantControllerCallbacks() {
@@ -250,6 +253,255 @@ func (suite *TestBaseMapperReadSuite) TestReadMany_WhenHavingController_CallRele
 		assert.Condition(suite.T(), dataComparison(&data, hdlr.afterData))
 		assert.Equal(suite.T(), ep, *hdlr.afterInfo)
 	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadMany_WhenQueryKeyIsNotAField_Got400() {
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt)
+
+	options := map[urlparam.Param]interface{}{urlparam.ParamOtherQueries: url.Values{"colour": []string{"red"}}}
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   options,
+		Who:         suite.who,
+	}
+	_, _, _, retErr := SharedOwnershipMapper().ReadMany(suite.db, &ep, &hook.Cargo{})
+	if assert.NotNil(suite.T(), retErr) {
+		_, ok := retErr.Renderer.(*webrender.ErrQueryParameter)
+		assert.True(suite.T(), ok)
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet()) // no query
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadMany_WhenOrderByRelevanceWithoutQ_Got400() {
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt)
+
+	options := map[urlparam.Param]interface{}{urlparam.ParamOrderBy: "relevance"}
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   options,
+		Who:         suite.who,
+	}
+	_, _, _, retErr := SharedOwnershipMapper().ReadMany(suite.db, &ep, &hook.Cargo{})
+	if assert.NotNil(suite.T(), retErr) {
+		_, ok := retErr.Renderer.(*webrender.ErrQueryParameter)
+		assert.True(suite.T(), ok)
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet()) // no query
+}
+
+func (suite *TestBaseMapperReadSuite) TestCreateBuilderFromQueryParameters_WhenCustomURLParam_Skipped() {
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt).CustomURLParams("colour")
+
+	builder, err := createBuilderFromQueryParameters(url.Values{"colour": []string{"red"}}, suite.typeString)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), builder)
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadMany_WhenARoleOfUserCannotSort_Got400BeforeQuerying() {
+	// Only the roles the user has, the cars aren't queried so a 400 doesn't tell whether any match
+	stmt := `SELECT DISTINCT role FROM "user_owns_car"  WHERE (user_id = $1)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(suite.who.GetUserID()).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleAdmin).AddRow(userrole.UserRoleGuest))
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt).SortableForRole(userrole.UserRoleGuest, "createdAt")
+
+	options := map[urlparam.Param]interface{}{urlparam.ParamOrderBy: "name"}
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   options,
+		Who:         suite.who,
+	}
+	_, _, _, retErr := SharedOwnershipMapper().ReadMany(suite.db, &ep, &hook.Cargo{})
+	if assert.NotNil(suite.T(), retErr) {
+		_, ok := retErr.Renderer.(*webrender.ErrQueryParameter)
+		assert.True(suite.T(), ok)
+		assert.Contains(suite.T(), retErr.Error.Error(), "name")
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadDistinct_WhenARoleOfUserCannotFilterByField_Got400() {
+	stmt := `SELECT DISTINCT role FROM "user_owns_car"  WHERE (user_id = $1)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(suite.who.GetUserID()).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleGuest))
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt).FilterableForRole(userrole.UserRoleGuest, "createdAt")
+
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   map[urlparam.Param]interface{}{},
+		Who:         suite.who,
+	}
+	_, retErr := SharedOwnershipMapper().ReadDistinct(suite.db, "name", &ep, &hook.Cargo{})
+	if assert.NotNil(suite.T(), retErr) {
+		_, ok := retErr.Renderer.(*webrender.ErrQueryParameter)
+		assert.True(suite.T(), ok)
+		assert.Contains(suite.T(), retErr.Error.Error(), "name")
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet()) // no values read
+}
+
+func (suite *TestBaseMapperReadSuite) TestCheckQueryFields_WhenLatestnDefaultsToCreatedAt_NotCheckedAsSortable() {
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt).Sortable("name")
+
+	topn := urlparam.TopN{N: 1, On: []string{"name"}, By: "createdAt", Desc: true, ByDefault: true}
+	options := map[urlparam.Param]interface{}{urlparam.ParamTopN: topn}
+	assert.Nil(suite.T(), checkQueryFields(suite.typeString, options))
+
+	// Asked for explicitly
+	topn.ByDefault = false
+	options[urlparam.ParamTopN] = topn
+	assert.NotNil(suite.T(), checkQueryFields(suite.typeString, options))
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadMany_WhenTopN_FiltersOnPartitionAndDeletedAtAreInsideRanking() {
+	stmt := `INNER JOIN (SELECT id, DENSE_RANK() OVER (PARTITION BY name ORDER BY created_at DESC) FROM car WHERE ` +
+		`"car"."name" IN ($1) AND car.deleted_at IS NULL) AS topn ON car.id = topn.id AND topn.dense_rank <= $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs("DSM", 1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Car{}, opt)
+
+	options := map[urlparam.Param]interface{}{
+		urlparam.ParamOtherQueries: url.Values{"name": []string{"DSM"}},
+		urlparam.ParamTopN:         urlparam.TopN{N: 1, On: []string{"name"}, By: "createdAt", Desc: true, ByDefault: true},
+	}
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   options,
+		Who:         suite.who,
+	}
+	SharedOwnershipMapper().ReadMany(suite.db, &ep, &hook.Cargo{})
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+type Garage struct {
+	mdl.BaseModel
+
+	Name   string  `json:"name"`
+	Levels []Level `json:"levels" betterrest:"peg"`
+
+	Ownerships []mdlutil.OwnershipModelWithIDBase `gorm:"PRELOAD:false" json:"-" betterrest:"ownership"`
+}
+
+type Level struct {
+	mdl.BaseModel
+
+	Floor    int            `json:"floor"`
+	GarageID *datatype.UUID `json:"garageID"`
+	Spots    []Spot         `json:"spots" betterrest:"peg"`
+}
+
+type Spot struct {
+	mdl.BaseModel
+
+	Number  int            `json:"number"`
+	LevelID *datatype.UUID `json:"levelID"`
+}
+
+// expectGarages expects the ReadMany queries of the garages and the user's roles to them
+func (suite *TestBaseMapperReadSuite) expectGarages(garageIDs ...*datatype.UUID) {
+	rows := sqlmock.NewRows([]string{"id", "name"})
+	roles := sqlmock.NewRows([]string{"role"})
+	for _, garageID := range garageIDs {
+		rows.AddRow(garageID, "Garage")
+		roles.AddRow(userrole.UserRoleAdmin)
+	}
+	suite.mock.ExpectQuery(`SELECT "garage"\.\* FROM "garage"`).WillReturnRows(rows)
+	suite.mock.ExpectQuery(`SELECT "user_owns_garage"\."role" FROM "garage"`).WillReturnRows(roles)
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadMany_WhenPegged_OneQueryPerRelationPerLevel() {
+	garageID1, garageID2 := datatype.NewUUID(), datatype.NewUUID()
+	levelID1, levelID2, levelID3 := datatype.NewUUID(), datatype.NewUUID(), datatype.NewUUID()
+	delete(registry.ModelRegistry, "garages")
+
+	suite.expectGarages(garageID1, garageID2)
+	// One query for the levels of both garages, and one for the spots of all levels
+	stmt := `SELECT * FROM "level"  WHERE "level"."deleted_at" IS NULL AND (("garage_id" IN ($1,$2)))`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(garageID1, garageID2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "floor", "garage_id"}).
+			AddRow(levelID1, 1, garageID1).AddRow(levelID2, 2, garageID1).AddRow(levelID3, 1, garageID2))
+	stmt2 := `SELECT * FROM "spot"  WHERE "spot"."deleted_at" IS NULL AND (("level_id" IN ($1,$2,$3)))`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WithArgs(levelID1, levelID2, levelID3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "number", "level_id"}).
+			AddRow(datatype.NewUUID(), 101, levelID1).AddRow(datatype.NewUUID(), 102, levelID1).AddRow(datatype.NewUUID(), 301, levelID3))
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For("garages").ModelWithOption(&Garage{}, opt)
+
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  "garages",
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	retVal, _, _, retErr := SharedOwnershipMapper().ReadMany(suite.db, &ep, &hook.Cargo{})
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	if assert.Len(suite.T(), retVal.Ms, 2) {
+		garage1, garage2 := retVal.Ms[0].(*Garage), retVal.Ms[1].(*Garage)
+		if assert.Len(suite.T(), garage1.Levels, 2) {
+			assert.Len(suite.T(), garage1.Levels[0].Spots, 2)
+			assert.Len(suite.T(), garage1.Levels[1].Spots, 0)
+		}
+		if assert.Len(suite.T(), garage2.Levels, 1) {
+			assert.Equal(suite.T(), 301, garage2.Levels[0].Spots[0].Number)
+		}
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperReadSuite) TestReadMany_WhenMaxPreloadDepth_StopsLoadingThere() {
+	garageID := datatype.NewUUID()
+	delete(registry.ModelRegistry, "garages")
+
+	suite.expectGarages(garageID)
+	stmt := `SELECT * FROM "level"  WHERE "level"."deleted_at" IS NULL AND (("garage_id" IN ($1)))`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "floor", "garage_id"}).AddRow(datatype.NewUUID(), 1, garageID))
+	// No query of spots
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For("garages").ModelWithOption(&Garage{}, opt).MaxPreloadDepth(1)
+
+	ep := hook.EndPoint{
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  "garages",
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	retVal, _, _, retErr := SharedOwnershipMapper().ReadMany(suite.db, &ep, &hook.Cargo{})
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	if assert.Len(suite.T(), retVal.Ms, 1) && assert.Len(suite.T(), retVal.Ms[0].(*Garage).Levels, 1) {
+		assert.Nil(suite.T(), retVal.Ms[0].(*Garage).Levels[0].Spots)
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
 }
 
 func TestBaseMappingReadSuite(t *testing.T) {
@@ -0,0 +1,267 @@
+package datamapper
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/hook/userrole"
+	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/libs/utils/transact"
+	"github.com/t2wu/betterrest/libs/webrender"
+	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/betterrest/model/mappertype"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// Truck is soft-deleted
+type Truck struct {
+	mdl.BaseModel
+
+	Name string `json:"name"`
+
+	Ownerships []mdlutil.OwnershipModelWithIDBase `gorm:"PRELOAD:false" json:"-" betterrest:"ownership"`
+}
+
+func (t *Truck) DoRealDelete() bool {
+	return false
+}
+
+// TruckQueryHook only reads Semis
+type TruckQueryHook struct {
+}
+
+func (h *TruckQueryHook) Init(data *hook.InitData, args ...interface{}) {
+}
+
+func (h *TruckQueryHook) BeforeQuery(db *gorm.DB, ep *hook.EndPoint) (*gorm.DB, *webrender.RetError) {
+	return db.Where(`"truck"."name" = ?`, "Semi"), nil
+}
+
+type TestBaseMapperSoftDeleteSuite struct {
+	suite.Suite
+	db         *gorm.DB
+	mock       sqlmock.Sqlmock
+	who        mdlutil.UserIDFetchable
+	typeString string
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) SetupTest() {
+	sqldb, mock, _ := sqlmock.New() // db, mock, error. We're testing lifecycle here
+	suite.db, _ = gorm.Open("postgres", sqldb)
+	suite.db.SingularTable(true)
+	suite.mock = mock
+	suite.who = &WhoMock{Oid: datatype.NewUUID()} // userid
+	suite.typeString = "trucks"
+
+	// clear registry
+	delete(registry.ModelRegistry, "trucks")
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPDSX", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Truck{}, opt)
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) ep(op rest.Op, options map[urlparam.Param]interface{}) *hook.EndPoint {
+	return &hook.EndPoint{
+		Op:          op,
+		Cardinality: rest.CardinalityOne,
+		TypeString:  suite.typeString,
+		URLParams:   options,
+		Who:         suite.who,
+	}
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestDeleteOne_WhenSoftDeleted_KeepsOwnership() {
+	truckID := datatype.NewUUID()
+	truckName := "Semi"
+
+	suite.mock.ExpectBegin()
+	stmt := `SELECT "truck".* FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2 WHERE "truck"."deleted_at" IS NULL`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(truckID, truckName))
+	stmt2 := `SELECT "user_owns_truck"."role" FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleAdmin))
+	// No DELETE FROM user_owns_truck
+	stmt3 := `UPDATE "truck" SET "deleted_at"=$1  WHERE "truck"."deleted_at" IS NULL AND "truck"."id" = $2`
+	suite.mock.ExpectExec(regexp.QuoteMeta(stmt3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	suite.mock.ExpectCommit()
+
+	mapper := SharedOwnershipMapper()
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) *webrender.RetError {
+		_, retErr := mapper.DeleteOne(tx, truckID, suite.ep(rest.OpDelete, map[urlparam.Param]interface{}{}), &hook.Cargo{})
+		return retErr
+	}, "lifecycle.DeleteOne")
+
+	assert.Nil(suite.T(), retErr)
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestReadMany_WhenIncludeDeleted_GotDeletedTruck() {
+	truckID := datatype.NewUUID()
+	truckName := "Semi"
+	deletedAt := time.Now()
+
+	// Deleted ones only where the user is the admin, in the query so the page isn't short
+	stmt := `SELECT "truck".* FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $1 WHERE ("truck"."deleted_at" IS NULL OR "user_owns_truck"."role" = $2) ORDER BY "truck"."created_at" DESC LIMIT 100 OFFSET 0`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(suite.who.GetUserID().String(), userrole.UserRoleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "deleted_at"}).AddRow(truckID, truckName, deletedAt))
+	stmt2 := `SELECT "user_owns_truck"."role" FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $1 WHERE ("truck"."deleted_at" IS NULL OR "user_owns_truck"."role" = $2) ORDER BY "truck"."created_at" DESC LIMIT 100 OFFSET 0`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleAdmin))
+
+	options := map[urlparam.Param]interface{}{
+		urlparam.ParamOffset:         0,
+		urlparam.ParamLimit:          100,
+		urlparam.ParamIncludeDeleted: true,
+	}
+	ep := suite.ep(rest.OpRead, options)
+	ep.Cardinality = rest.CardinalityMany
+
+	mapper := SharedOwnershipMapper()
+	retVal, _, _, retErr := mapper.ReadMany(suite.db, ep, &hook.Cargo{})
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	if assert.Len(suite.T(), retVal.Ms, 1) {
+		assert.Equal(suite.T(), truckID.String(), retVal.Ms[0].GetID().String())
+		assert.NotNil(suite.T(), retVal.Ms[0].(*Truck).DeletedAt)
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) expectReadOneTruck(truckID *datatype.UUID, deletedAt time.Time, role userrole.UserRole) {
+	// No WHERE "truck"."deleted_at" IS NULL
+	stmt := `SELECT "truck".* FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id = $1 INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "deleted_at"}).AddRow(truckID, "Semi", deletedAt))
+	suite.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_owns_truck"  WHERE (user_id = $1 AND model_id = $2)`)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "model_id", "role"}).AddRow(suite.who.GetUserID(), truckID, role))
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestReadOne_WhenIncludeDeleted_GotDeletedTruck() {
+	truckID := datatype.NewUUID()
+	suite.expectReadOneTruck(truckID, time.Now(), userrole.UserRoleAdmin)
+
+	options := map[urlparam.Param]interface{}{urlparam.ParamIncludeDeleted: true}
+	mapper := SharedOwnershipMapper()
+	retVal, _, retErr := mapper.ReadOne(suite.db, truckID, suite.ep(rest.OpRead, options), &hook.Cargo{})
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	assert.NotNil(suite.T(), retVal.Ms[0].(*Truck).DeletedAt)
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestReadOne_WhenIncludeDeletedAndNotAdmin_GotNotFound() {
+	truckID := datatype.NewUUID()
+	suite.expectReadOneTruck(truckID, time.Now(), userrole.UserRoleGuest)
+
+	options := map[urlparam.Param]interface{}{urlparam.ParamIncludeDeleted: true}
+	mapper := SharedOwnershipMapper()
+	_, _, retErr := mapper.ReadOne(suite.db, truckID, suite.ep(rest.OpRead, options), &hook.Cargo{})
+	if assert.NotNil(suite.T(), retErr) {
+		assert.True(suite.T(), gorm.IsRecordNotFoundError(retErr.Error))
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestReadOne_WhenIncludeDeletedAndBeforeQuery_CountsDeletedTruck() {
+	delete(registry.ModelRegistry, suite.typeString)
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPDSX", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Truck{}, opt).Hook(&TruckQueryHook{}, "R")
+
+	truckID := datatype.NewUUID()
+	suite.expectReadOneTruck(truckID, time.Now(), userrole.UserRoleAdmin)
+	// No "truck"."deleted_at" IS NULL in the count either
+	stmt := `SELECT count(*) FROM "truck"  WHERE ("truck"."id" = $1) AND ("truck"."name" = $2)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(truckID, "Semi").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	options := map[urlparam.Param]interface{}{urlparam.ParamIncludeDeleted: true}
+	mapper := SharedOwnershipMapper()
+	retVal, _, retErr := mapper.ReadOne(suite.db, truckID, suite.ep(rest.OpRead, options), &hook.Cargo{})
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	assert.NotNil(suite.T(), retVal.Ms[0].(*Truck).DeletedAt)
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestRestoreOne_WhenSoftDeleted_GotTruck() {
+	truckID := datatype.NewUUID()
+	truckName := "Semi"
+	deletedAt := time.Now()
+
+	suite.mock.ExpectBegin()
+	// Found through the ownership table, which was kept
+	stmt := `SELECT "truck".* FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "deleted_at"}).AddRow(truckID, truckName, deletedAt))
+	stmt2 := `SELECT "user_owns_truck"."role" FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleAdmin))
+	stmt3 := `UPDATE "truck" SET "deleted_at" = $1 WHERE "truck"."id" = $2`
+	suite.mock.ExpectExec(regexp.QuoteMeta(stmt3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	stmt4 := `SELECT "truck".* FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id = $1 INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2 WHERE "truck"."deleted_at" IS NULL`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt4)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(truckID, truckName))
+	stmt5 := `SELECT * FROM "user_owns_truck"  WHERE (user_id = $1 AND model_id = $2)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt5)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "model_id", "role"}).AddRow(suite.who.GetUserID(), truckID, userrole.UserRoleAdmin))
+	suite.mock.ExpectCommit()
+
+	mapper := SharedOwnershipMapper()
+	var retVal *MapperRet
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		retVal, retErr = mapper.RestoreOne(tx, truckID, suite.ep(rest.OpRestore, map[urlparam.Param]interface{}{}), &hook.Cargo{})
+		return retErr
+	}, "lifecycle.RestoreOne")
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	if truck, ok := retVal.Ms[0].(*Truck); assert.True(suite.T(), ok) {
+		assert.Equal(suite.T(), truckName, truck.Name)
+		assert.Nil(suite.T(), truck.DeletedAt)
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperSoftDeleteSuite) TestPurgeOne_WhenSoftDeleted_DeletesOwnership() {
+	truckID := datatype.NewUUID()
+	truckName := "Semi"
+	deletedAt := time.Now()
+
+	suite.mock.ExpectBegin()
+	stmt := `SELECT "truck".* FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "deleted_at"}).AddRow(truckID, truckName, deletedAt))
+	stmt2 := `SELECT "user_owns_truck"."role" FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id AND "truck".id IN ($1) INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $2`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(userrole.UserRoleAdmin))
+	stmt3 := `DELETE FROM user_owns_truck WHERE model_id = $1`
+	suite.mock.ExpectExec(regexp.QuoteMeta(stmt3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	stmt4 := `DELETE FROM "truck"  WHERE "truck"."id" = $1`
+	suite.mock.ExpectExec(regexp.QuoteMeta(stmt4)).WillReturnResult(sqlmock.NewResult(0, 1))
+	suite.mock.ExpectCommit()
+
+	mapper := SharedOwnershipMapper()
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) *webrender.RetError {
+		_, retErr := mapper.PurgeOne(tx, truckID, suite.ep(rest.OpPurge, map[urlparam.Param]interface{}{}), &hook.Cargo{})
+		return retErr
+	}, "lifecycle.PurgeOne")
+
+	assert.Nil(suite.T(), retErr)
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func TestBaseMappingSoftDeleteSuite(t *testing.T) {
+	suite.Run(t, new(TestBaseMapperSoftDeleteSuite))
+}
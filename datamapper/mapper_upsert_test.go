@@ -0,0 +1,206 @@
+package datamapper
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/libs/utils/transact"
+	"github.com/t2wu/betterrest/libs/webrender"
+	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/betterrest/model/mappertype"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+type TestBaseMapperUpsertSuite struct {
+	suite.Suite
+	db         *gorm.DB
+	mock       sqlmock.Sqlmock
+	who        mdlutil.UserIDFetchable
+	typeString string
+}
+
+func (suite *TestBaseMapperUpsertSuite) SetupTest() {
+	sqldb, mock, _ := sqlmock.New() // db, mock, error. We're testing lifecycle here
+	suite.db, _ = gorm.Open("postgres", sqldb)
+	suite.db.SingularTable(true)
+	suite.mock = mock
+	suite.who = &WhoMock{Oid: datatype.NewUUID()} // userid
+	suite.typeString = "trucks"
+
+	// clear registry
+	delete(registry.ModelRegistry, "trucks")
+
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.DirectOwnership}
+	registry.For(suite.typeString).ModelWithOption(&Truck{}, opt).Upsert("name")
+}
+
+func (suite *TestBaseMapperUpsertSuite) ep(op rest.Op) *hook.EndPoint {
+	return &hook.EndPoint{
+		Op:          op,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+}
+
+func (suite *TestBaseMapperUpsertSuite) TestModelsExist_WhenNaturalKeyMatches_SetsID() {
+	truckID := datatype.NewUUID()
+
+	// only looks among the trucks the user has access to
+	stmt := `SELECT "truck".id, "truck".deleted_at FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $1 WHERE ("truck"."name" = $2)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(suite.who.GetUserID(), "Semi").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "deleted_at"}).AddRow(truckID, nil))
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(suite.who.GetUserID(), "Pickup").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "deleted_at"}))
+
+	modelObjs := []mdl.IModel{&Truck{Name: "Semi"}, &Truck{Name: "Pickup"}}
+	exists, deleted, retErr := SharedOwnershipMapper().ModelsExist(suite.db, modelObjs, suite.ep(rest.OpUpdate))
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	assert.Equal(suite.T(), []bool{true, false}, exists)
+	assert.Equal(suite.T(), []bool{false, false}, deleted)
+	assert.Equal(suite.T(), truckID.String(), modelObjs[0].GetID().String())
+	assert.Nil(suite.T(), modelObjs[1].GetID())
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperUpsertSuite) TestModelsExist_WhenSoftDeleted_ReportsItWithoutRestoring() {
+	truckID := datatype.NewUUID()
+	deletedAt := time.Now()
+
+	stmt := `SELECT "truck".id, "truck".deleted_at FROM "truck" INNER JOIN "user_owns_truck" ON "truck".id = "user_owns_truck".model_id INNER JOIN "user" ON "user".id = "user_owns_truck".user_id AND "user_owns_truck".user_id = $1 WHERE ("truck"."name" = $2)`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WithArgs(suite.who.GetUserID(), "Semi").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "deleted_at"}).AddRow(truckID, deletedAt))
+	// no UPDATE here, restoring is up to lifecycle through RestoreOne
+
+	modelObjs := []mdl.IModel{&Truck{Name: "Semi"}}
+	exists, deleted, retErr := SharedOwnershipMapper().ModelsExist(suite.db, modelObjs, suite.ep(rest.OpUpdate))
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	assert.Equal(suite.T(), []bool{true}, exists)
+	assert.Equal(suite.T(), []bool{true}, deleted)
+	assert.Equal(suite.T(), truckID.String(), modelObjs[0].GetID().String())
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperUpsertSuite) TestCreate_WhenInserted_OnlyModelTableHasOnConflict() {
+	truckID := datatype.NewUUID()
+
+	suite.mock.ExpectBegin()
+	stmt1 := `INSERT INTO "truck" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5) ON CONFLICT ("name") DO NOTHING RETURNING "truck"."id"`
+	// ownership link is inserted as usual
+	stmt2 := `INSERT INTO "user_owns_truck" ("id","created_at","updated_at","deleted_at","role","user_id","model_id") VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "user_owns_truck"."id"`
+	stmt3 := `SELECT * FROM "truck" WHERE "truck"."deleted_at" IS NULL AND "truck"."id" = $1 LIMIT 1`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt1)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(truckID))
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt2)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(datatype.NewUUID()))
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt3)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(truckID, "Semi"))
+	suite.mock.ExpectCommit()
+
+	mapper := SharedOwnershipMapper()
+	ep := hook.EndPoint{
+		Op:          rest.OpCreate,
+		Cardinality: rest.CardinalityOne,
+		TypeString:  suite.typeString,
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	var retVal *MapperRet
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		tx, err := UpsertInsertDB(tx, suite.typeString)
+		if err != nil {
+			return &webrender.RetError{Error: err}
+		}
+		retVal, retErr = mapper.Create(tx, []mdl.IModel{&Truck{BaseModel: mdl.BaseModel{ID: truckID}, Name: "Semi"}}, &ep, &hook.Cargo{})
+		return retErr
+	}, "lifecycle.UpsertOne")
+	if !assert.Nil(suite.T(), retErr) {
+		return
+	}
+
+	if assert.Len(suite.T(), retVal.Ms, 1) {
+		assert.Equal(suite.T(), truckID.String(), retVal.Ms[0].GetID().String())
+	}
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperUpsertSuite) TestCreate_WhenInsertedByAnotherRequest_Got409() {
+	suite.mock.ExpectBegin()
+	stmt := `INSERT INTO "truck" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5) ON CONFLICT ("name") DO NOTHING RETURNING "truck"."id"`
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WillReturnRows(sqlmock.NewRows([]string{"id"})) // nothing inserted
+	suite.mock.ExpectRollback()
+
+	mapper := SharedOwnershipMapper()
+	ep := hook.EndPoint{
+		Op:          rest.OpCreate,
+		Cardinality: rest.CardinalityOne,
+		TypeString:  suite.typeString,
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		tx, err := UpsertInsertDB(tx, suite.typeString)
+		if err != nil {
+			return &webrender.RetError{Error: err}
+		}
+		_, retErr = mapper.Create(tx, []mdl.IModel{&Truck{Name: "Semi"}}, &ep, &hook.Cargo{})
+		return retErr
+	}, "lifecycle.UpsertOne")
+
+	if !assert.NotNil(suite.T(), retErr) {
+		return
+	}
+	_, ok := retErr.Renderer.(*webrender.ErrUpsertConflict)
+	assert.True(suite.T(), ok)
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func (suite *TestBaseMapperUpsertSuite) TestCreateMany_WhenOneInsertedByAnotherRequest_Got409() {
+	suite.mock.ExpectBegin()
+	stmt := `INSERT INTO "truck" ("id","created_at","updated_at","deleted_at","name") VALUES ($1,$2,$3,$4,$5),($6,$7,$8,$9,$10) ON CONFLICT ("name") DO NOTHING RETURNING *`
+	// Only the first one
+	suite.mock.ExpectQuery(regexp.QuoteMeta(stmt)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(datatype.NewUUID(), "Semi"))
+	suite.mock.ExpectRollback()
+
+	mapper := SharedOwnershipMapper()
+	ep := hook.EndPoint{
+		Op:          rest.OpCreate,
+		Cardinality: rest.CardinalityMany,
+		TypeString:  suite.typeString,
+		URLParams:   make(map[urlparam.Param]interface{}),
+		Who:         suite.who,
+	}
+	retErr := transact.TransactCustomError(suite.db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		tx, err := UpsertInsertDB(tx, suite.typeString)
+		if err != nil {
+			return &webrender.RetError{Error: err}
+		}
+		_, retErr = mapper.Create(tx, []mdl.IModel{&Truck{Name: "Semi"}, &Truck{Name: "Pickup"}}, &ep, &hook.Cargo{})
+		return retErr
+	}, "lifecycle.UpsertMany")
+
+	if !assert.NotNil(suite.T(), retErr) {
+		return
+	}
+	_, ok := retErr.Renderer.(*webrender.ErrUpsertConflict)
+	assert.True(suite.T(), ok)
+	assert.Nil(suite.T(), suite.mock.ExpectationsWereMet())
+}
+
+func TestBaseMappingUpsertSuite(t *testing.T) {
+	suite.Run(t, new(TestBaseMapperUpsertSuite))
+}
@@ -1,14 +1,19 @@
 package datamapper
 
 import (
+	"database/sql"
 	"fmt"
 
 	"github.com/jinzhu/gorm"
+	"github.com/t2wu/betterrest/datamapper/gormfixes"
 	"github.com/t2wu/betterrest/datamapper/hfetcher"
 	"github.com/t2wu/betterrest/datamapper/service"
 	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/libs/settings"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/betterrest/registry"
 	"github.com/t2wu/qry/datatype"
 	"github.com/t2wu/qry/mdl"
 )
@@ -25,6 +30,30 @@ type batchOpJob struct {
 	fetcher *hfetcher.HandlerFetcher
 	data    *hook.Data
 	ep      *hook.EndPoint
+
+	// bulkTaskFunc, if set, does the task for all models at once (create only)
+	bulkTaskFunc func(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObjs []mdl.IModel) ([]mdl.IModel, error)
+}
+
+// bulkCreateTask returns the service's bulk create if there are more than one models
+// and they can be created that way, otherwise nil
+func bulkCreateTask(serv service.IService, db *gorm.DB, modelObjs []mdl.IModel) func(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObjs []mdl.IModel) ([]mdl.IModel, error) {
+	if bulk, ok := serv.(service.IBulkCreator); ok && len(modelObjs) > 1 && gormfixes.CanBulkCreate(db, modelObjs[0]) {
+		return bulk.CreateManyCore
+	}
+	return nil
+}
+
+// taskError is the RetError of an error from the task, with a renderer for the ones the client can act on
+func taskError(err error, ep *hook.EndPoint) *webrender.RetError {
+	if _, ok := err.(*gormfixes.DeleteRestrictedError); ok {
+		return webrender.NewRetValWithRendererError(err, webrender.NewErrDeleteRestricted(err))
+	}
+	// Nothing inserted because of the ON CONFLICT DO NOTHING of upsert, see UpsertInsertDB
+	if ep.Op == rest.OpCreate && (err == sql.ErrNoRows || err == gormfixes.ErrInsertConflict) {
+		return webrender.NewRetValWithRendererError(err, webrender.NewErrUpsertConflict(err))
+	}
+	return &webrender.RetError{Error: err}
 }
 
 func batchOpCore(job batchOpJob,
@@ -39,6 +68,12 @@ func batchOpCore(job batchOpJob,
 		return nil, &webrender.RetError{Error: fmt.Errorf("cargo shouldn't be nil")}
 	}
 
+	// For delete, restore and purge the models are loaded ones
+	data.OldMs = oldmodelObjs
+	if data.OldMs == nil && ep.Op != rest.OpCreate {
+		data.OldMs = modelObjs
+	}
+
 	// fetch all handlers with before hooks
 	for _, hdlr := range fetcher.FetchHandlersForOpAndHook(ep.Op, "B") { // FetchHandlersForOpAndHook is stateful, cannot be repeated called
 		if renderer := hdlr.(hook.IBefore).Before(data, ep); renderer != nil {
@@ -46,23 +81,44 @@ func batchOpCore(job batchOpJob,
 		}
 	}
 
-	// TODO: Could update all at once, then load all at once again
-	for i, modelObj := range modelObjs {
-		id := modelObj.GetID()
+	var auditBefore []*registry.RawJSON
+	if settings.Audit {
+		var err error
+		if auditBefore, err = auditSnapshots(job); err != nil {
+			return nil, &webrender.RetError{Error: err}
+		}
+	}
 
-		// m, err := updateOneCore(serv, db, oid, scope, typeString, modelObj, id)
-		var m mdl.IModel
+	if job.bulkTaskFunc != nil {
 		var err error
-		if oldmodelObjs == nil {
-			m, err = taskFunc(data.DB, ep.Who, ep.TypeString, modelObj, id, nil)
-		} else {
-			m, err = taskFunc(data.DB, ep.Who, ep.TypeString, modelObj, id, oldmodelObjs[i])
+		if ms, err = job.bulkTaskFunc(data.DB, ep.Who, ep.TypeString, modelObjs); err != nil {
+			return nil, taskError(err, ep)
 		}
-		if err != nil { // Error is "record not found" when not found
-			return nil, &webrender.RetError{Error: err}
+	} else {
+		// TODO: Could update all at once, then load all at once again
+		for i, modelObj := range modelObjs {
+			id := modelObj.GetID()
+
+			// m, err := updateOneCore(serv, db, oid, scope, typeString, modelObj, id)
+			var m mdl.IModel
+			var err error
+			if oldmodelObjs == nil {
+				m, err = taskFunc(data.DB, ep.Who, ep.TypeString, modelObj, id, nil)
+			} else {
+				m, err = taskFunc(data.DB, ep.Who, ep.TypeString, modelObj, id, oldmodelObjs[i])
+			}
+			if err != nil { // Error is "record not found" when not found
+				return nil, taskError(err, ep)
+			}
+
+			ms[i] = m
 		}
+	}
 
-		ms[i] = m
+	if settings.Audit {
+		if err := writeAudit(data.DB, ep, auditBefore, ms); err != nil {
+			return nil, &webrender.RetError{Error: err}
+		}
 	}
 
 	// fetch all handlers with after hooks
@@ -74,6 +130,7 @@ func batchOpCore(job batchOpJob,
 
 	return &MapperRet{
 		Ms:      ms,
+		OldMs:   data.OldMs,
 		Fetcher: fetcher,
 	}, nil
 }
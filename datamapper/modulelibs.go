@@ -3,15 +3,27 @@ package datamapper
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/url"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/t2wu/betterrest/datamapper/gormfixes"
+	"github.com/t2wu/betterrest/datamapper/hfetcher"
 	"github.com/t2wu/betterrest/datamapper/service"
+	"github.com/t2wu/betterrest/hook"
 	"github.com/t2wu/betterrest/hook/userrole"
+	"github.com/t2wu/betterrest/libs/gotag"
+	"github.com/t2wu/betterrest/libs/settings"
 	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/libs/utils/sqlbuilder"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/betterrest/model/mappertype"
 	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry"
 	"github.com/t2wu/qry/datatype"
 	"github.com/t2wu/qry/mdl"
 
@@ -105,6 +117,47 @@ func loadAndCheckErrorBeforeModifyV2(serv service.IService, db *gorm.DB, who mdl
 	return modelObj2, role, nil
 }
 
+// beforeQuery gives the read query to the IBeforeQuery hooks to add to
+func beforeQuery(fetcher *hfetcher.HandlerFetcher, db *gorm.DB, ep *hook.EndPoint) (*gorm.DB, *webrender.RetError) {
+	for _, hdlr := range fetcher.FetchHandlersForOpAndHook(ep.Op, "Q") {
+		var retErr *webrender.RetError
+		if db, retErr = hdlr.(hook.IBeforeQuery).BeforeQuery(db, ep); retErr != nil {
+			return nil, retErr
+		}
+	}
+	return db, nil
+}
+
+// beforeQueryAllowsOne checks the record loaded by ReadOne against the IBeforeQuery hooks. The
+// loading query also reads the role and such so the hooks can't be given that one, the record is
+// counted again with what they add instead (a deleted one as well with includeDeleted).
+func beforeQueryAllowsOne(fetcher *hfetcher.HandlerFetcher, db *gorm.DB, ep *hook.EndPoint, id *datatype.UUID) (bool, *webrender.RetError) {
+	hdlrs := fetcher.FetchHandlersForOpAndHook(ep.Op, "Q")
+	if len(hdlrs) == 0 {
+		return true, nil
+	}
+
+	if urlparam.GetIncludeDeleted(ep.URLParams) {
+		db = db.Unscoped().Set(service.KeyIncludeDeleted, true)
+	}
+
+	rtable := registry.GetTableNameFromTypeString(ep.TypeString)
+	db = db.Set("gorm:auto_preload", false).Model(registry.NewFromTypeString(ep.TypeString)).
+		Where(fmt.Sprintf(`"%s"."id" = ?`, rtable), id)
+	for _, hdlr := range hdlrs {
+		var retErr *webrender.RetError
+		if db, retErr = hdlr.(hook.IBeforeQuery).BeforeQuery(db, ep); retErr != nil {
+			return false, retErr
+		}
+	}
+
+	var count int
+	if err := db.Count(&count).Error; err != nil {
+		return false, &webrender.RetError{Error: err}
+	}
+	return count != 0, nil
+}
+
 // func loadAndCheckErrorBeforeModifyV1(serv service.IServiceV1, db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObj mdl.IModel, id *datatype.UUID, permittedRoles []userrole.UserRole) (mdl.IModel, userrole.UserRole, error) {
 // 	if id == nil || id.UUID.String() == "" {
 // 		// in case it's an empty string
@@ -241,3 +294,353 @@ func applyPatchCore(typeString string, modelObj mdl.IModel, jsonPatch []byte) (m
 
 	return modelObj2, nil
 }
+
+// readDistinctCore counts the distinct values of field, with the same permission query and
+// URL filters as ReadMany
+func readDistinctCore(serv service.IService, db *gorm.DB, field string, ep *hook.EndPoint) ([]DistinctValue, *webrender.RetError) {
+	modelObj := registry.NewFromTypeString(ep.TypeString)
+
+	// Important!! Check if field is actually part of the schema, otherwise risk of sequal injection
+	fieldName, err := mdl.JSONKeysToFieldName(modelObj, field)
+	if err != nil {
+		err = fmt.Errorf("field %s not in %s", field, strings.ToLower(ep.TypeString))
+		return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	// pegged and associated structs are not columns
+	if structField, ok := reflect.TypeOf(modelObj).Elem().FieldByName(fieldName); !ok ||
+		gotag.TagValueHasPrefix(structField.Tag.Get("betterrest"), "peg") {
+		err = fmt.Errorf("field %s is not a column", field)
+		return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	column, err := mdl.FieldNameToColumn(modelObj, fieldName)
+	if err != nil {
+		return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	if !registry.ModelRegistry[ep.TypeString].IsFilterable(field) {
+		err = fmt.Errorf("%s cannot be used in query", field)
+		return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	if err := checkQueryFields(ep.TypeString, ep.URLParams); err != nil {
+		return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	// The field's values are as good as filtering by it
+	if retErr := checkRoleQueryFields(db, ep.Who, ep.TypeString, ep.URLParams, field); retErr != nil {
+		return nil, retErr
+	}
+
+	db = db.Set("gorm:auto_preload", false)
+	offset, limit, cstart, cstop, _, _, _, _, _ := urlparam.GetOptions(ep.URLParams)
+	rtable := registry.GetTableNameFromTypeString(ep.TypeString)
+
+	if cstart != nil && cstop != nil {
+		db = db.Where(rtable+`.created_at BETWEEN ? AND ?`, time.Unix(int64(*cstart), 0), time.Unix(int64(*cstop), 0))
+	}
+
+	if ranges := urlparam.GetTimeRanges(ep.URLParams); len(ranges) != 0 {
+		db, err = constructTimeRangeQueries(db, ep.TypeString, rtable, ranges)
+		if err != nil {
+			return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+	}
+
+	if search := urlparam.GetSearch(ep.URLParams); search != nil {
+		db, err = sqlbuilder.AddFullTextSearchStmt(db, ep.TypeString, rtable, *search)
+		if err != nil {
+			return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+	}
+
+	db, builder, retErr := constructFilterQueries(db, ep.TypeString, rtable, ep.URLParams)
+	if retErr != nil {
+		return nil, retErr
+	}
+
+	db, err = serv.GetAllQueryContructCore(db, ep.Who, ep.TypeString)
+	if err != nil {
+		return nil, &webrender.RetError{Error: err}
+	}
+
+	initData := hook.InitData{Roles: nil, Ep: ep}
+	fetcher := hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData)
+	if db, retErr = beforeQuery(fetcher, db, ep); retErr != nil {
+		return nil, retErr
+	}
+
+	if offset != nil && limit != nil {
+		db = db.Offset(*offset).Limit(*limit)
+	} else {
+		db = db.Offset(0).Limit(100)
+	}
+
+	if builder != nil {
+		db, err = qry.Q(db, builder).BuildQuery(modelObj)
+		if err != nil {
+			return nil, &webrender.RetError{Error: err}
+		}
+		db = db.Set("gorm:auto_preload", false)
+	}
+
+	// Table is already set, so it's missing WHERE "model"."deleted_at" IS NULL
+	col := fmt.Sprintf(`"%s"."%s"`, rtable, column)
+	rows, err := db.Where(fmt.Sprintf(`"%s"."deleted_at" IS NULL`, rtable)).
+		Select(col+` AS value, COUNT(*) AS count`).Group(col).Order(`count DESC`, true).Rows() // hooks may have ordered
+	if err != nil {
+		return nil, &webrender.RetError{Error: err}
+	}
+	defer rows.Close()
+
+	values := make([]DistinctValue, 0)
+	for rows.Next() {
+		v := DistinctValue{}
+		if err := rows.Scan(&v.Value, &v.Count); err != nil {
+			return nil, &webrender.RetError{Error: err}
+		}
+		if b, ok := v.Value.([]byte); ok { // uuid and such comes back as bytes
+			v.Value = string(b)
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// constructFilterQueries adds the URL query filters and topn. It returns the qry builder for the filters,
+// which should be built after the rest of the query. With settings.LegacyLatestN, latestn goes through
+// the old path instead and the builder is nil.
+func constructFilterQueries(db *gorm.DB, typeString string, tableName string,
+	options map[urlparam.Param]interface{}) (*gorm.DB, *qry.PredicateRelationBuilder, *webrender.RetError) {
+	var err error
+	_, _, _, _, _, _, latestn, latestnons, _ := urlparam.GetOptions(options)
+	if latestn != nil && settings.LegacyLatestN {
+		db, err = constructInnerFieldParamQueries(db, typeString, options, latestn, latestnons)
+		if err != nil {
+			return nil, nil, &webrender.RetError{Error: err}
+		}
+		return db, nil, nil
+	}
+
+	var builder *qry.PredicateRelationBuilder
+	if urlParams, ok := options[urlparam.ParamOtherQueries].(url.Values); ok && len(urlParams) != 0 {
+		builder, err = createBuilderFromQueryParameters(urlParams, typeString)
+		if err != nil {
+			return nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+	}
+
+	if topn := urlparam.GetTopN(options); topn != nil {
+		db, err = constructTopNQuery(db, typeString, tableName, topn, options)
+		if err != nil {
+			return nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+		}
+	}
+
+	return db, builder, nil
+}
+
+// loadDeletedForModify loads a soft-deleted record and checks the permission for ep.Op (restore or purge)
+func loadDeletedForModify(serv service.IService, mapperType mappertype.MapperType, db *gorm.DB, id *datatype.UUID,
+	ep *hook.EndPoint) (mdl.IModel, userrole.UserRole, *webrender.RetError) {
+	var rolesToErrMap = make(map[userrole.UserRole]*webrender.RetError)
+	rolesToErrMap[userrole.UserRoleAdmin] = nil // at least contain this
+	if registry.RoleSorter != nil {
+		var err error
+		rolesToErrMap, err = registry.RoleSorter.Permitted(mapperType, ep)
+		if err != nil {
+			return nil, userrole.UserRoleInvalid, webrender.NewRetValWithError(err)
+		}
+	}
+
+	db = db.Unscoped().Set(service.KeyIncludeDeleted, true)
+	modelObjs, roles, retErr := loadManyAndCheckBeforeModifyV3(serv, db, ep.Who, ep.TypeString, []*datatype.UUID{id}, ep.URLParams, rolesToErrMap)
+	if retErr != nil {
+		if retErr.Error.Error() == "record not found" || retErr.Error.Error() == "not found" {
+			return nil, userrole.UserRoleInvalid, webrender.NewRetValWithRendererError(retErr.Error, webrender.NewErrNotFound(retErr.Error))
+		}
+		return nil, userrole.UserRoleInvalid, retErr
+	}
+
+	if modelNeedsRealDelete(modelObjs[0]) {
+		err := fmt.Errorf("%s is not soft-deleted", ep.TypeString)
+		return nil, userrole.UserRoleInvalid, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	if gormfixes.DeletedAt(modelObjs[0]) == nil {
+		err := fmt.Errorf("%s is not deleted", id.String())
+		return nil, userrole.UserRoleInvalid, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	return modelObjs[0], roles[0], nil
+}
+
+// restoreOneCore un-deletes a soft-deleted record along with its pegged records
+func restoreOneCore(serv service.IService, mapperType mappertype.MapperType, db *gorm.DB, id *datatype.UUID,
+	ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	modelObj, role, retErr := loadDeletedForModify(serv, mapperType, db, id, ep)
+	if retErr != nil {
+		return nil, retErr
+	}
+
+	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: db, Roles: []userrole.UserRole{role}, Cargo: cargo}
+	initData := hook.InitData{Roles: []userrole.UserRole{role}, Ep: ep}
+
+	j := batchOpJob{
+		serv:      serv,
+		modelObjs: []mdl.IModel{modelObj},
+		fetcher:   hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData),
+		data:      &data,
+		ep:        ep,
+	}
+	retVal, retErr := batchOpCore(j, func(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObj mdl.IModel,
+		id *datatype.UUID, oldModelObj mdl.IModel) (mdl.IModel, error) {
+		if err := gormfixes.RestoreModelAndPeg(db, modelObj); err != nil {
+			return nil, err
+		}
+
+		// Load it back with the pegged records
+		modelObj, _, err := serv.ReadOneCore(db, who, typeString, id, ep.URLParams)
+		return modelObj, err
+	})
+	if retErr != nil {
+		return nil, retErr
+	}
+
+	retVal.Roles = []userrole.UserRole{role} // for rendering
+	return retVal, nil
+}
+
+// purgeOneCore hard-deletes a soft-deleted record along with its pegged records
+func purgeOneCore(serv service.IService, mapperType mappertype.MapperType, db *gorm.DB, id *datatype.UUID,
+	ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	modelObj, role, retErr := loadDeletedForModify(serv, mapperType, db, id, ep)
+	if retErr != nil {
+		return nil, retErr
+	}
+
+	db = db.Unscoped() // REAL delete
+
+	// Removes the links (like the ownership rows) which were kept when it was soft-deleted
+	modelObj, err := serv.HookBeforeDeleteOne(db, ep.Who, ep.TypeString, modelObj)
+	if err != nil {
+		return nil, &webrender.RetError{Error: err}
+	}
+
+	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: db, Roles: []userrole.UserRole{role}, Cargo: cargo}
+	initData := hook.InitData{Roles: []userrole.UserRole{role}, Ep: ep}
+
+	j := batchOpJob{
+		serv:      serv,
+		modelObjs: []mdl.IModel{modelObj},
+		fetcher:   hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData),
+		data:      &data,
+		ep:        ep,
+	}
+	return batchOpCore(j, serv.DeleteOneCore)
+}
+
+// includeDeletedOfAdmin reads soft-deleted records as well, but only those the user is the admin of.
+// It's part of the query so the pages and the total count are right.
+func includeDeletedOfAdmin(db *gorm.DB, typeString string) *gorm.DB {
+	db = db.Unscoped().Set(service.KeyIncludeDeleted, true)
+	if !gormfixes.SoftDeletable(registry.NewFromTypeString(typeString)) {
+		return db
+	}
+
+	where, args := service.DeletedOnlyOfAdminWhere(typeString)
+	return db.Where(where, args...)
+}
+
+// modelsExistCore tells which of the models exist among the records the user can access, for upsert,
+// and which of those are soft-deleted. A model is looked up by its ID, or by the registered natural key
+// if the ID isn't given, in which case the ID of the existing record is set on the model. The ones not
+// found are to be created with UpsertInsertDB.
+func modelsExistCore(serv service.IService, db *gorm.DB, who mdlutil.UserIDFetchable, typeString string,
+	modelObjs []mdl.IModel) ([]bool, []bool, error) {
+	reg := registry.ModelRegistry[typeString]
+	tableName := registry.GetTableNameFromTypeString(typeString)
+	db = db.Unscoped()
+
+	softDeletable := gormfixes.SoftDeletable(registry.NewFromTypeString(typeString))
+	columns := fmt.Sprintf("\"%s\".id", tableName)
+	if softDeletable {
+		columns += fmt.Sprintf(", \"%s\".deleted_at", tableName)
+	}
+
+	exists, deleted := make([]bool, len(modelObjs)), make([]bool, len(modelObjs))
+	for i, modelObj := range modelObjs {
+		q, err := serv.GetAllQueryContructCore(db, who, typeString)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if id := modelObj.GetID(); id != nil {
+			q = q.Where(fmt.Sprintf("\"%s\".id = ?", tableName), id)
+		} else if len(reg.NaturalKey) != 0 {
+			v := reflect.Indirect(reflect.ValueOf(modelObj))
+			for _, key := range reg.NaturalKey {
+				fieldName, err := mdl.JSONKeysToFieldName(modelObj, key)
+				if err != nil {
+					return nil, nil, err
+				}
+				column, err := mdl.FieldNameToColumn(modelObj, fieldName)
+				if err != nil {
+					return nil, nil, err
+				}
+				q = q.Where(fmt.Sprintf("\"%s\".\"%s\" = ?", tableName, column), v.FieldByName(fieldName).Interface())
+			}
+		} else {
+			continue // to be created
+		}
+
+		rows := make([]struct {
+			ID        *datatype.UUID
+			DeletedAt *time.Time
+		}, 0)
+		if err := q.Select(columns).Scan(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+		if len(rows) > 1 {
+			return nil, nil, fmt.Errorf("natural key %s matches more than one %s", strings.Join(reg.NaturalKey, ","), typeString)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		exists[i], deleted[i] = true, rows[0].DeletedAt != nil
+		if modelObj.GetID() == nil {
+			modelObj.SetID(rows[0].ID)
+		}
+	}
+
+	return exists, deleted, nil
+}
+
+// UpsertInsertDB is db for creating the models ModelsExist didn't find. If another request inserts the
+// same natural key (or ID if there isn't one) in the meantime, nothing is inserted and the create
+// fails with 409, rather than the second request creating a duplicate or failing with 500. Upsert
+// isn't atomic: it's not ON CONFLICT DO UPDATE since the update has to go through its permission and
+// hooks, so the client retries the 409 (which then updates).
+func UpsertInsertDB(db *gorm.DB, typeString string) (*gorm.DB, error) {
+	columns := []string{"\"id\""}
+	if reg := registry.ModelRegistry[typeString]; len(reg.NaturalKey) != 0 {
+		modelObj := registry.NewFromTypeString(typeString)
+		columns = make([]string, 0, len(reg.NaturalKey))
+		for _, key := range reg.NaturalKey {
+			fieldName, err := mdl.JSONKeysToFieldName(modelObj, key)
+			if err != nil {
+				return nil, err
+			}
+			column, err := mdl.FieldNameToColumn(modelObj, fieldName)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, fmt.Sprintf("\"%s\"", column))
+		}
+	}
+
+	return gormfixes.InsertOnConflictDoNothing(db, registry.GetTableNameFromTypeString(typeString), columns), nil
+}
@@ -3,7 +3,6 @@ package datamapper
 import (
 	"errors"
 	"fmt"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +14,7 @@ import (
 	"github.com/t2wu/betterrest/hook"
 	"github.com/t2wu/betterrest/hook/userrole"
 	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/libs/utils/sqlbuilder"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/model/mappertype"
@@ -143,6 +143,8 @@ func (mapper *OrgPartition) Create(db *gorm.DB, modelObjs []mdl.IModel,
 		fetcher: hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData),
 		data:    data,
 		ep:      ep,
+
+		bulkTaskFunc: bulkCreateTask(mapper.Service, db, modelObjs),
 	}
 	return batchOpCore(j, mapper.Service.CreateOneCore)
 }
@@ -153,45 +155,78 @@ func (mapper *OrgPartition) ReadMany(db *gorm.DB, ep *hook.EndPoint,
 	db = db.Set("gorm:auto_preload", false)
 	db2 := db
 
-	offset, limit, cstart, cstop, _, _, latestn, latestnons, totalcount := urlparam.GetOptions(ep.URLParams)
+	offset, limit, cstart, cstop, _, _, _, _, totalcount := urlparam.GetOptions(ep.URLParams)
 	if cstart == nil || cstop == nil {
 		err := fmt.Errorf("GET /%s needs cstart and cstop parameters", strings.ToLower(ep.TypeString))
 		return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
 	}
 
+	if err := checkQueryFields(ep.TypeString, ep.URLParams); err != nil {
+		return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+	if retErr := checkRoleQueryFields(dbClean, ep.Who, ep.TypeString, ep.URLParams); retErr != nil {
+		return nil, nil, nil, retErr
+	}
+
+	// By default only pegged ones, and they're queried by dates as well
+	begin, end := time.Unix(int64(*cstart), 0), time.Unix(int64(*cstop), 0)
+	loader, err := associationLoader(dbClean, ep.TypeString, ep.URLParams, service.AssociationLoader{
+		PegOnly: true,
+		PegScope: func(db *gorm.DB, tableName string) *gorm.DB {
+			return db.Where(fmt.Sprintf("\"%s\".created_at BETWEEN ? AND ?", tableName), begin, end)
+		},
+	})
+	if err != nil {
+		return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	if urlparam.GetIncludeDeleted(ep.URLParams) {
+		db = includeDeletedOfAdmin(db, ep.TypeString)
+	}
+
 	rtable := registry.GetTableNameFromTypeString(ep.TypeString)
 
 	if cstart != nil && cstop != nil {
 		db = db.Where(rtable+".created_at BETWEEN ? AND ?", time.Unix(int64(*cstart), 0), time.Unix(int64(*cstop), 0))
 	}
 
-	var err error
-	var builder *qry.PredicateRelationBuilder
-	if latestn != nil { // query module currently don't handle latestn, use old if so
-		db, err = constructInnerFieldParamQueries(db, ep.TypeString, ep.URLParams, latestn, latestnons)
+	if ranges := urlparam.GetTimeRanges(ep.URLParams); len(ranges) != 0 {
+		db, err = constructTimeRangeQueries(db, ep.TypeString, rtable, ranges)
 		if err != nil {
-			return nil, nil, nil, &webrender.RetError{Error: err}
+			return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
 		}
-	} else {
-		if urlParams, ok := ep.URLParams[urlparam.ParamOtherQueries].(url.Values); ok && len(urlParams) != 0 {
-			builder, err = createBuilderFromQueryParameters(urlParams, ep.TypeString)
-			if err != nil {
-				return nil, nil, nil, &webrender.RetError{Error: err}
-			}
+	}
+
+	search := urlparam.GetSearch(ep.URLParams)
+	if search != nil {
+		db, err = sqlbuilder.AddFullTextSearchStmt(db, ep.TypeString, rtable, *search)
+		if err != nil {
+			return nil, nil, nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
 		}
 	}
 
+	db, builder, retErr := constructFilterQueries(db, ep.TypeString, rtable, ep.URLParams)
+	if retErr != nil {
+		return nil, nil, nil, retErr
+	}
+
 	var orderby *string
 	order := "desc"
-	db, err = constructOrderFieldQueries(db, ep.TypeString, rtable, orderby, &order)
-	if err != nil {
-		return nil, nil, nil, &webrender.RetError{Error: err}
+	if db, retErr = constructOrderFieldQueries(db, ep.TypeString, rtable, orderby, &order, search); retErr != nil {
+		return nil, nil, nil, retErr
 	}
 	db, err = mapper.Service.GetAllQueryContructCore(db, ep.Who, ep.TypeString)
 	if err != nil {
 		return nil, nil, nil, &webrender.RetError{Error: err}
 	}
 
+	initData := hook.InitData{Roles: nil, Ep: ep} // roles are set once they're queried
+	fetcher := hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData)
+	db = constructOnlyIDsQuery(db, rtable, ep.URLParams)
+	if db, retErr = beforeQuery(fetcher, db, ep); retErr != nil {
+		return nil, nil, nil, retErr
+	}
+
 	var no *int
 	if totalcount {
 		no = new(int)
@@ -235,8 +270,12 @@ func (mapper *OrgPartition) ReadMany(db *gorm.DB, ep *hook.EndPoint,
 		return nil, nil, nil, &webrender.RetError{Error: err}
 	}
 
-	// Now need to recursively walks through outmodes and query by dates
-	service.RecursivelyQueryAllPeggedModels(db2, outmodels, time.Unix(int64(*cstart), 0), time.Unix(int64(*cstop), 0))
+	// Now need to walk through outmodels and query by dates, level by level
+	if loader != nil {
+		if err := loader.Load(db2, outmodels); err != nil {
+			return nil, nil, nil, &webrender.RetError{Error: err}
+		}
+	}
 
 	roles, err := mapper.Service.GetAllRolesCore(db, dbClean, ep.Who, ep.TypeString, outmodels)
 	if err != nil {
@@ -258,9 +297,7 @@ func (mapper *OrgPartition) ReadMany(db *gorm.DB, ep *hook.EndPoint,
 
 	// use dbClean cuz it's not chained
 	data := hook.Data{Ms: outmodels, DB: dbClean, Roles: roles, Cargo: cargo}
-	initData := hook.InitData{Roles: roles, Ep: ep}
-
-	fetcher := hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData)
+	initData.Roles = roles
 
 	// New after hooks
 	// fetch all handlers with before hooks
@@ -294,6 +331,10 @@ func (mapper *OrgPartition) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.End
 		return nil, userrole.UserRoleInvalid, &webrender.RetError{Error: service.ErrIDEmpty}
 	}
 
+	if urlparam.GetIncludeDeleted(ep.URLParams) {
+		db = db.Unscoped().Set(service.KeyIncludeDeleted, true)
+	}
+
 	// Yes we actually want to read here
 	modelObj, role, err := loadAndCheckErrorBeforeModifyV2(mapper.Service, db, ep.Who, ep.TypeString, nil, id,
 		[]userrole.UserRole{userrole.UserRoleAny}, ep.URLParams)
@@ -304,9 +345,21 @@ func (mapper *OrgPartition) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.End
 		return nil, userrole.UserRoleInvalid, &webrender.RetError{Error: err}
 	}
 
+	if gormfixes.DeletedAt(modelObj) != nil && role != userrole.UserRoleAdmin { // only admin can see deleted ones
+		err = gorm.ErrRecordNotFound
+		return nil, userrole.UserRoleInvalid, webrender.NewRetValWithRendererError(err, webrender.NewErrNotFound(err))
+	}
+
 	initData := hook.InitData{Roles: []userrole.UserRole{role}, Ep: ep}
 	fetcher := hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData)
 
+	if found, retErr := beforeQueryAllowsOne(fetcher, db, ep, id); retErr != nil {
+		return nil, userrole.UserRoleInvalid, retErr
+	} else if !found {
+		err = gorm.ErrRecordNotFound
+		return nil, userrole.UserRoleInvalid, webrender.NewRetValWithRendererError(err, webrender.NewErrNotFound(err))
+	}
+
 	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: db, Roles: []userrole.UserRole{role}, Cargo: cargo}
 
 	// fetch all handlers with before hooks
@@ -324,6 +377,17 @@ func (mapper *OrgPartition) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.End
 	return &ret, role, nil
 }
 
+// ReadDistinct counts the distinct values of a field, within the cstart and cstop partitions
+func (mapper *OrgPartition) ReadDistinct(db *gorm.DB, field string, ep *hook.EndPoint, cargo *hook.Cargo) ([]DistinctValue, *webrender.RetError) {
+	_, _, cstart, cstop, _, _, _, _, _ := urlparam.GetOptions(ep.URLParams)
+	if cstart == nil || cstop == nil {
+		err := fmt.Errorf("GET /%s/distinct/%s needs cstart and cstop parameters", strings.ToLower(ep.TypeString), field)
+		return nil, webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+	}
+
+	return readDistinctCore(mapper.Service, db, field, ep)
+}
+
 // // UpdateOne updates model based on this json
 // func (mapper *OrgPartition) UpdateOne(db *gorm.DB, modelObj mdl.IModel, id *datatype.UUID,
 // 	ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
@@ -654,6 +718,27 @@ func (mapper *OrgPartition) DeleteOne(db *gorm.DB, id *datatype.UUID, ep *hook.E
 	return batchOpCore(j, mapper.Service.DeleteOneCore)
 }
 
+// RestoreOne un-deletes a soft-deleted record
+func (mapper *OrgPartition) RestoreOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint,
+	cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	return restoreOneCore(mapper.Service, mapper.MapperType, db, id, ep, cargo)
+}
+
+// ModelsExist tells which of the models exist among the records the user can access, for upsert
+func (mapper *OrgPartition) ModelsExist(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint) ([]bool, []bool, *webrender.RetError) {
+	exists, deleted, err := modelsExistCore(mapper.Service, db, ep.Who, ep.TypeString, modelObjs)
+	if err != nil {
+		return nil, nil, &webrender.RetError{Error: err}
+	}
+	return exists, deleted, nil
+}
+
+// PurgeOne hard-deletes a soft-deleted record
+func (mapper *OrgPartition) PurgeOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint,
+	cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	return purgeOneCore(mapper.Service, mapper.MapperType, db, id, ep, cargo)
+}
+
 // DeleteMany deletes multiple mdl
 func (mapper *OrgPartition) DeleteMany(db *gorm.DB, modelObjs []mdl.IModel,
 	ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
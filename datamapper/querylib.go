@@ -3,15 +3,25 @@ package datamapper
 import (
 	"fmt"
 	"log"
+	"net/url"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/stoewer/go-strcase"
+	"github.com/t2wu/betterrest/datamapper/gormfixes"
+	"github.com/t2wu/betterrest/datamapper/service"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/betterrest/libs/urlparam"
 	"github.com/t2wu/betterrest/libs/utils/letters"
 	"github.com/t2wu/betterrest/libs/utils/sqlbuilder"
+	"github.com/t2wu/betterrest/libs/webrender"
+	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/registry"
 	"github.com/t2wu/qry"
 	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
 )
 
 func getPredicateAndValueFromFieldValue2(fieldVal string) (string, string) {
@@ -152,7 +162,7 @@ func constructDbFromURLFieldQuery(db *gorm.DB, typeString string, urlParams map[
 		if err != nil {
 			return db, err
 		}
-	} else if latestn != nil {
+	} else if latestn != nil && settings.LegacyLatestN {
 		log.Println("GOING TO BE DEPRECATED")
 		// DEPRECATED: old behavior where there may is latestn but not latestnons
 		db, err = sqlbuilder.AddLatestJoinWithOneLevelFilter(db, typeString, registry.GetTableNameFromTypeString(typeString), *latestn, filters)
@@ -234,3 +244,196 @@ func urlLevel2ParametersToMapOfMap(urlParameters map[string][]string) (map[strin
 	}
 	return dic, nil
 }
+
+// constructTimeRangeQueries adds the range on time fields other than created_at (cstart and cstop)
+func constructTimeRangeQueries(db *gorm.DB, typeString string, tableName string, ranges []urlparam.TimeRange) (*gorm.DB, error) {
+	modelObj := registry.NewFromTypeString(typeString)
+	timeType := reflect.TypeOf(time.Time{})
+	for _, r := range ranges {
+		// Important!! Check if fieldName is actually part of the schema, otherwise risk of sequal injection
+		fieldName, err := mdl.JSONKeysToFieldName(modelObj, r.FieldName)
+		if err != nil {
+			return nil, fmt.Errorf("field %s not in %s", r.FieldName, strings.ToLower(typeString))
+		}
+
+		fieldType, err := datatype.GetModelFieldTypeElmIfValid(modelObj, fieldName)
+		if err != nil {
+			return nil, err
+		}
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType != timeType {
+			return nil, fmt.Errorf("field %s is not a time", r.FieldName)
+		}
+
+		column, err := mdl.FieldNameToColumn(modelObj, fieldName)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Start != nil {
+			db = db.Where(fmt.Sprintf(`"%s"."%s" >= ?`, tableName, column), *r.Start)
+		}
+		if r.Stop != nil {
+			db = db.Where(fmt.Sprintf(`"%s"."%s" <= ?`, tableName, column), *r.Stop)
+		}
+	}
+
+	return db, nil
+}
+
+// checkQueryFields makes sure the URL query and orderby only use fields allowed for this typeString
+func checkQueryFields(typeString string, options map[urlparam.Param]interface{}) error {
+	reg := registry.ModelRegistry[typeString]
+	filterKeys, sortKeys := queryFieldKeys(options)
+	for _, key := range filterKeys {
+		if !reg.IsFilterable(key) {
+			return fmt.Errorf("%s cannot be used in query", key)
+		}
+	}
+
+	for _, key := range sortKeys {
+		if !reg.IsSortable(key) {
+			return fmt.Errorf("%s cannot be used in orderby", key)
+		}
+	}
+
+	return nil
+}
+
+// checkRoleQueryFields makes sure every role the user has to records of this typeString permits the
+// fields in the query (and moreFilterKeys). It's checked before the query is run, so whether it's a 400
+// doesn't tell anything about the records the query would find.
+func checkRoleQueryFields(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, options map[urlparam.Param]interface{},
+	moreFilterKeys ...string) *webrender.RetError {
+	reg := registry.ModelRegistry[typeString]
+	if reg.RoleFilterableFields == nil && reg.RoleSortableFields == nil {
+		return nil
+	}
+
+	roles, err := service.RolesOfUser(db, who, typeString)
+	if err != nil {
+		return &webrender.RetError{Error: err}
+	}
+
+	filterKeys, sortKeys := queryFieldKeys(options)
+	filterKeys = append(filterKeys, moreFilterKeys...)
+	for _, role := range roles {
+		for _, key := range filterKeys {
+			if !reg.RolePermitsFields(role, []string{key}, nil) {
+				err := fmt.Errorf("%s cannot be used in query by your role", key)
+				return webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+			}
+		}
+		for _, key := range sortKeys {
+			if !reg.RolePermitsFields(role, nil, []string{key}) {
+				err := fmt.Errorf("%s cannot be used in orderby by your role", key)
+				return webrender.NewRetValWithRendererError(err, webrender.NewErrQueryParameter(err))
+			}
+		}
+	}
+
+	return nil
+}
+
+func queryFieldKeys(options map[urlparam.Param]interface{}) (filterKeys []string, sortKeys []string) {
+	filterKeys, sortKeys = make([]string, 0), make([]string, 0)
+	if urlParams, ok := options[urlparam.ParamOtherQueries].(url.Values); ok {
+		for key := range urlParams {
+			filterKeys = append(filterKeys, key)
+		}
+	}
+
+	for _, r := range urlparam.GetTimeRanges(options) {
+		filterKeys = append(filterKeys, r.FieldName)
+	}
+
+	_, _, _, _, orderby, _, _, _, _ := urlparam.GetOptions(options)
+	if orderby != nil && *orderby != "relevance" {
+		sortKeys = append(sortKeys, *orderby)
+	}
+
+	if topn := urlparam.GetTopN(options); topn != nil {
+		filterKeys = append(filterKeys, topn.On...)
+		if !topn.ByDefault {
+			sortKeys = append(sortKeys, topn.By)
+		}
+	}
+
+	return filterKeys, sortKeys
+}
+
+// constructTopNQuery keeps only the top n records in each group
+func constructTopNQuery(db *gorm.DB, typeString string, tableName string, topn *urlparam.TopN,
+	options map[urlparam.Param]interface{}) (*gorm.DB, error) {
+	m := registry.NewFromTypeString(typeString)
+	partitionBy := make([]string, len(topn.On))
+	for i, key := range topn.On {
+		column, err := jsonKeyToColumn(m, key)
+		if err != nil {
+			return db, err
+		}
+		partitionBy[i] = column
+	}
+
+	orderBy, err := jsonKeyToColumn(m, topn.By)
+	if err != nil {
+		return db, err
+	}
+
+	// Filters on the topnon fields go inside too
+	partitionFilters := make([]sqlbuilder.FilterCriteria, 0)
+	if urlParams, ok := options[urlparam.ParamOtherQueries].(url.Values); ok {
+		_, partitionFilters, err = createFiltersAndLatestnonFilters(urlParams, topn.On)
+		if err != nil {
+			return db, err
+		}
+	}
+
+	excludeDeleted := gormfixes.SoftDeletable(m) && !urlparam.GetIncludeDeleted(options)
+	return sqlbuilder.AddTopNJoin(db, typeString, tableName, topn.N, partitionBy, orderBy, topn.Desc, partitionFilters, excludeDeleted)
+}
+
+// jsonKeyToColumn checks the JSON key is in the model and returns the column name
+func jsonKeyToColumn(modelObj mdl.IModel, key string) (string, error) {
+	fieldName, err := mdl.JSONKeysToFieldName(modelObj, key)
+	if err != nil {
+		return "", err
+	}
+	return mdl.FieldNameToColumn(modelObj, fieldName)
+}
+
+// associationLoader returns the loader according to the preload URL parameter, or nil if nothing
+// is to be loaded. defaultLoader is used when there is no preload parameter.
+func associationLoader(db *gorm.DB, typeString string, options map[urlparam.Param]interface{},
+	defaultLoader service.AssociationLoader) (*service.AssociationLoader, error) {
+	loader := defaultLoader
+	if maxDepth := registry.ModelRegistry[typeString].MaxPreloadDepth; maxDepth > 0 {
+		loader.MaxDepth = maxDepth
+	}
+
+	preload := urlparam.GetPreload(options)
+	switch {
+	case preload == nil:
+	case preload.All:
+		loader.PegOnly = false
+	case len(preload.Paths) == 0: // none
+		return nil, nil
+	default:
+		if err := service.CheckPreloadPaths(db, registry.NewFromTypeString(typeString), preload.Paths); err != nil {
+			return nil, err
+		}
+		loader.Paths = preload.Paths
+	}
+
+	return &loader, nil
+}
+
+// constructOnlyIDsQuery limits the read to the IDs in urlparam.ParamOnlyIDs if there are
+func constructOnlyIDsQuery(db *gorm.DB, rtable string, options map[urlparam.Param]interface{}) *gorm.DB {
+	if ids := urlparam.GetOnlyIDs(options); ids != nil {
+		db = db.Where(fmt.Sprintf(`"%s"."id" IN (?)`, rtable), ids)
+	}
+	return db
+}
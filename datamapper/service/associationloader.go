@@ -0,0 +1,372 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/t2wu/betterrest/libs/gotag"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/qry/mdl"
+)
+
+// AssociationLoader loads the associations of models breadth-first. At each level the keys of all
+// the parents are collected, and each relation is one IN query (two for many-to-many), instead of
+// queries per parent. It replaces gorm:auto_preload and RecursivelyQueryAllPeggedModels in ReadMany.
+type AssociationLoader struct {
+	// MaxDepth is the number of levels under the models to load, settings.PreloadMaxDepth if 0
+	MaxDepth int
+
+	// PegOnly loads peg relations only
+	PegOnly bool
+
+	// PegScope, if given, adds conditions to the query of peg relations (such as created_at range
+	// for partitioned tables)
+	PegScope func(db *gorm.DB, tableName string) *gorm.DB
+
+	// Paths, if not nil, are the only associations loaded (JSON keys joined by dots, such as
+	// locations.doors, which loads locations as well). PegOnly doesn't apply to them.
+	Paths []string
+}
+
+// parentAtPath is a loaded model and the path of JSON keys to it
+type parentAtPath struct {
+	v    reflect.Value
+	path string
+}
+
+// Load loads the associations of modelObjs, which are from the same table
+func (l *AssociationLoader) Load(db *gorm.DB, modelObjs []mdl.IModel) error {
+	// Not the conditions of the main query, and soft-deleted records not loaded just like preload
+	db = db.New().Set("gorm:auto_preload", false)
+
+	maxDepth := l.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = settings.PreloadMaxDepth
+	}
+
+	var selected map[string]bool
+	if l.Paths != nil {
+		selected = make(map[string]bool)
+		for _, path := range l.Paths {
+			keys := strings.Split(path, ".")
+			for i := range keys {
+				selected[strings.Join(keys[:i+1], ".")] = true
+			}
+		}
+	}
+
+	parents := make([]parentAtPath, len(modelObjs))
+	for i, modelObj := range modelObjs {
+		parents[i] = parentAtPath{v: reflect.ValueOf(modelObj)}
+	}
+
+	type typeAndPath struct {
+		typ  reflect.Type
+		path string
+	}
+
+	for depth := 0; depth < maxDepth && len(parents) != 0; depth++ {
+		// Parents at this level can be from different tables
+		groups := make(map[typeAndPath][]reflect.Value)
+		keys := make([]typeAndPath, 0)
+		for _, parent := range parents {
+			key := typeAndPath{typ: parent.v.Elem().Type(), path: parent.path}
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], parent.v)
+		}
+
+		children := make([]parentAtPath, 0)
+		for _, key := range keys {
+			for _, field := range db.NewScope(groups[key][0].Interface()).GetModelStruct().StructFields {
+				path := jsonKeyOfField(field)
+				if key.path != "" {
+					path = key.path + "." + path
+				}
+				if selected != nil && !selected[path] {
+					continue
+				}
+
+				loaded, err := l.loadField(db, groups[key], field, selected != nil)
+				if err != nil {
+					return err
+				}
+				for _, v := range loaded {
+					children = append(children, parentAtPath{v: v, path: path})
+				}
+			}
+		}
+
+		parents = children
+	}
+
+	return nil
+}
+
+// CheckPreloadPaths returns an error if any of the paths isn't an association of modelObj
+func CheckPreloadPaths(db *gorm.DB, modelObj mdl.IModel, paths []string) error {
+	for _, path := range paths {
+		typ := reflect.Indirect(reflect.ValueOf(modelObj)).Type()
+		for _, key := range strings.Split(path, ".") {
+			var found *gorm.StructField
+			for _, field := range db.NewScope(reflect.New(typ).Interface()).GetModelStruct().StructFields {
+				if jsonKeyOfField(field) == key && (field.Relationship != nil || gotag.TagValueHasPrefix(field.Tag.Get("betterrest"), "peg")) {
+					found = field
+					break
+				}
+			}
+			if found == nil {
+				return fmt.Errorf("cannot preload %s", path)
+			}
+
+			typ = found.Struct.Type
+			for typ.Kind() == reflect.Slice || typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+		}
+	}
+	return nil
+}
+
+func jsonKeyOfField(field *gorm.StructField) string {
+	if key := strings.Split(field.Tag.Get("json"), ",")[0]; key != "" {
+		return key
+	}
+	return field.Name
+}
+
+// loadField loads one relation of the parents, and returns the pointers to the loaded models.
+// If selected, PegOnly doesn't apply.
+func (l *AssociationLoader) loadField(db *gorm.DB, parents []reflect.Value, field *gorm.StructField, selected bool) ([]reflect.Value, error) {
+	tagVal := field.Tag.Get("betterrest")
+	if gotag.TagValueHasPrefix(tagVal, "peg-ignore") {
+		return nil, nil
+	}
+	if val, ok := field.TagSettingsGet("PRELOAD"); ok && !selected {
+		if preload, err := strconv.ParseBool(val); err == nil && !preload {
+			return nil, nil
+		}
+	}
+
+	relTag := ""
+	for _, pair := range strings.Split(tagVal, ";") {
+		if pair == "peg" || pair == "pegassoc" || strings.HasPrefix(pair, "pegassoc-manytomany") {
+			relTag = pair
+		}
+	}
+	if l.PegOnly && !selected && relTag != "peg" {
+		return nil, nil
+	}
+
+	elemTyp := field.Struct.Type
+	for elemTyp.Kind() == reflect.Slice || elemTyp.Kind() == reflect.Ptr {
+		elemTyp = elemTyp.Elem()
+	}
+	childModel, ok := reflect.New(elemTyp).Interface().(mdl.IModel)
+	if !ok {
+		return nil, nil
+	}
+	childTable := mdl.GetTableNameFromIModel(childModel)
+
+	q := db.Table(childTable)
+	if relTag == "peg" && l.PegScope != nil {
+		q = l.PegScope(q, childTable)
+	}
+
+	// key of the parent -> the loaded models
+	var byKey map[string][]reflect.Value
+	var parentKeyField string
+	var err error
+
+	rel := field.Relationship
+	switch {
+	case strings.HasPrefix(relTag, "pegassoc-manytomany"):
+		// Gorm's many-to-many doesn't work with our IDs (see LoadManyToManyBecauseGormFailsWithID)
+		parentTable := mdl.GetTableNameFromIModel(parents[0].Interface().(mdl.IModel))
+		linkTable := strings.Split(relTag, ":")[1]
+		parentKeyField = "ID"
+		byKey, err = loadThroughLinkTable(q, parents, parentKeyField, elemTyp, linkTable, parentTable+"_id", childTable+"_id", "id", "ID")
+	case rel == nil || len(rel.ForeignFieldNames) != 1 || len(rel.AssociationForeignFieldNames) != 1:
+		return nil, nil // not an association, or a composite key (not supported)
+	case rel.Kind == "has_many" || rel.Kind == "has_one":
+		parentKeyField = rel.AssociationForeignFieldNames[0]
+		byKey, err = loadByColumn(q, parents, parentKeyField, elemTyp, rel.ForeignDBNames[0], rel.ForeignFieldNames[0])
+	case rel.Kind == "belongs_to":
+		parentKeyField = rel.ForeignFieldNames[0]
+		byKey, err = loadByColumn(q, parents, parentKeyField, elemTyp, rel.AssociationForeignDBNames[0], rel.AssociationForeignFieldNames[0])
+	case rel.Kind == "many_to_many" && rel.JoinTableHandler != nil:
+		childKeyField := rel.AssociationForeignFieldNames[0]
+		childKeyColumn := gorm.ToColumnName(childKeyField)
+		if f, ok := db.NewScope(childModel).FieldByName(childKeyField); ok {
+			childKeyColumn = f.DBName
+		}
+		parentKeyField = rel.ForeignFieldNames[0]
+		byKey, err = loadThroughLinkTable(q, parents, parentKeyField, elemTyp, rel.JoinTableHandler.Table(db),
+			rel.ForeignDBNames[0], rel.AssociationForeignDBNames[0], childKeyColumn, childKeyField)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return assignLoaded(parents, field.Name, parentKeyField, byKey), nil
+}
+
+// loadByColumn loads models whose column matches the parents' key field
+func loadByColumn(q *gorm.DB, parents []reflect.Value, parentKeyField string, elemTyp reflect.Type,
+	column string, keyField string) (map[string][]reflect.Value, error) {
+	keys := fieldValues(parents, parentKeyField)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	slice := reflect.New(reflect.SliceOf(reflect.PtrTo(elemTyp)))
+	if err := q.Where(fmt.Sprintf("\"%s\" IN (?)", column), keys).Find(slice.Interface()).Error; err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string][]reflect.Value)
+	for i := 0; i < slice.Elem().Len(); i++ {
+		m := slice.Elem().Index(i)
+		k := keyString(m.Elem().FieldByName(keyField))
+		byKey[k] = append(byKey[k], m)
+	}
+	return byKey, nil
+}
+
+// loadThroughLinkTable loads the models linked to the parents in linkTable
+func loadThroughLinkTable(q *gorm.DB, parents []reflect.Value, parentKeyField string, elemTyp reflect.Type,
+	linkTable string, parentColumn string, childColumn string, childKeyColumn string, childKeyField string) (map[string][]reflect.Value, error) {
+	keys := fieldValues(parents, parentKeyField)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	stmt := fmt.Sprintf("SELECT \"%s\", \"%s\" FROM \"%s\" WHERE \"%s\" IN (?)", parentColumn, childColumn, linkTable, parentColumn)
+	rows, err := q.New().Raw(stmt, keys).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// child key -> parent keys
+	links := make(map[string][]string)
+	childKeys := make([]interface{}, 0)
+	for rows.Next() {
+		var parentKey, childKey string
+		if err := rows.Scan(&parentKey, &childKey); err != nil {
+			return nil, err
+		}
+		if _, ok := links[childKey]; !ok {
+			childKeys = append(childKeys, childKey)
+		}
+		links[childKey] = append(links[childKey], parentKey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(childKeys) == 0 {
+		return nil, nil
+	}
+
+	slice := reflect.New(reflect.SliceOf(reflect.PtrTo(elemTyp)))
+	if err := q.Where(fmt.Sprintf("\"%s\" IN (?)", childKeyColumn), childKeys).Find(slice.Interface()).Error; err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string][]reflect.Value)
+	for i := 0; i < slice.Elem().Len(); i++ {
+		m := slice.Elem().Index(i)
+		for _, parentKey := range links[keyString(m.Elem().FieldByName(childKeyField))] {
+			byKey[parentKey] = append(byKey[parentKey], m)
+		}
+	}
+	return byKey, nil
+}
+
+// assignLoaded sets the loaded models to the field of each parent, and returns pointers to them
+// as they are in the parents (so the next level is loaded into the parents)
+func assignLoaded(parents []reflect.Value, fieldName string, parentKeyField string, byKey map[string][]reflect.Value) []reflect.Value {
+	loaded := make([]reflect.Value, 0)
+	for _, parent := range parents {
+		ms := byKey[keyString(parent.Elem().FieldByName(parentKeyField))]
+		f := parent.Elem().FieldByName(fieldName)
+
+		switch f.Kind() {
+		case reflect.Slice:
+			arr := reflect.MakeSlice(f.Type(), 0, len(ms))
+			for _, m := range ms {
+				if f.Type().Elem().Kind() == reflect.Ptr {
+					arr = reflect.Append(arr, m)
+				} else {
+					arr = reflect.Append(arr, m.Elem())
+				}
+			}
+			f.Set(arr)
+
+			for j := 0; j < f.Len(); j++ {
+				if f.Index(j).Kind() == reflect.Ptr {
+					loaded = append(loaded, f.Index(j))
+				} else {
+					loaded = append(loaded, f.Index(j).Addr())
+				}
+			}
+		case reflect.Ptr:
+			if len(ms) != 0 {
+				f.Set(ms[0])
+				loaded = append(loaded, f)
+			}
+		case reflect.Struct:
+			if len(ms) != 0 {
+				f.Set(ms[0].Elem())
+				loaded = append(loaded, f.Addr())
+			}
+		}
+	}
+	return loaded
+}
+
+// fieldValues returns the distinct non-nil values of the field in models
+func fieldValues(models []reflect.Value, fieldName string) []interface{} {
+	seen := make(map[string]bool)
+	values := make([]interface{}, 0, len(models))
+	for _, m := range models {
+		f := m.Elem().FieldByName(fieldName)
+		if !f.IsValid() || (f.Kind() == reflect.Ptr && f.IsNil()) {
+			continue
+		}
+		if k := keyString(f); !seen[k] {
+			seen[k] = true
+			values = append(values, f.Interface())
+		}
+	}
+	return values
+}
+
+// keyString is used to match keys, the same value whether it's a pointer or not
+func keyString(v reflect.Value) string {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return ""
+	}
+
+	if v.CanAddr() {
+		if s, ok := v.Addr().Interface().(fmt.Stringer); ok {
+			return s.String()
+		}
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
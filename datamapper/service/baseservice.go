@@ -50,6 +50,11 @@ type IService interface {
 	PermissionAndRole(data *hook.Data, ep *hook.EndPoint) (*hook.Data, *webrender.RetError)
 }
 
+// IBulkCreator is implemented by services which can create many models with multi-row INSERTs
+type IBulkCreator interface {
+	CreateManyCore(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObjs []mdl.IModel) ([]mdl.IModel, error)
+}
+
 // BaseService is the superclass of all services
 type BaseService struct {
 }
@@ -81,6 +86,15 @@ func (serv *BaseService) CreateOneCore(db *gorm.DB, who mdlutil.UserIDFetchable,
 	return modelObj, nil
 }
 
+// CreateManyCore creates the models and their pegged models with multi-row INSERTs.
+// Check gormfixes.CanBulkCreate first.
+func (serv *BaseService) CreateManyCore(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObjs []mdl.IModel) ([]mdl.IModel, error) {
+	if err := gormfixes.BulkCreateModelsAndPeg(db, modelObjs); err != nil {
+		return nil, err
+	}
+	return modelObjs, nil
+}
+
 // UpdateOneCore one, permissin should already be checked
 // called for patch operation as well (after patch has already applied)
 // Fuck, repeat the following code for now (you can't call the overriding method from the non-overriding one)
@@ -131,6 +145,11 @@ func (serv *BaseService) UpdateOneCore(db *gorm.DB, who mdlutil.UserIDFetchable,
 
 func (serv *BaseService) DeleteOneCore(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObj mdl.IModel, id *datatype.UUID, oldModelObjs mdl.IModel) (mdl.IModel, error) {
 	// Many field is not used, it's just used to conform the interface
+	// onDelete:restrict and setnull go first, the foreign keys still point to the parent
+	if err := gormfixes.ApplyOnDeleteActions(db, modelObj); err != nil {
+		return nil, err
+	}
+
 	if err := db.Delete(modelObj).Error; err != nil {
 		return nil, err
 	}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/stoewer/go-strcase"
+	"github.com/t2wu/betterrest/datamapper/gormfixes"
 	"github.com/t2wu/betterrest/libs/gotag"
 	"github.com/t2wu/qry/datatype"
 	"github.com/t2wu/qry/mdl"
@@ -40,6 +41,10 @@ func RecursivelyQueryAllPeggedModels(db *gorm.DB, modelObjs []mdl.IModel, begin
 
 			tableName := mdl.GetTableNameFromIModel(modelAndIDs.ModelObj)
 			db3 := db.Where(tableName+".created_at BETWEEN ? AND ?", begin, end)
+			if gormfixes.SoftDeletable(modelAndIDs.ModelObj) {
+				// Soft-deleted children are gone, even if db is unscoped
+				db3 = db3.Where(fmt.Sprintf("\"%s\".\"deleted_at\" IS NULL", tableName))
+			}
 			if err := db3.Where(fmt.Sprintf("%s_id IN (?)", parentTableName), modelAndIDs.IDs.ToSlice()).
 				Find(sliceI).Error; err != nil {
 				return err
@@ -128,6 +128,10 @@ func (serv *OwnershipService) HookBeforeDeleteOne(db *gorm.DB, who mdlutil.UserI
 	// I'm removing stuffs from this link table, I cannot just remove myself from this. I have to remove
 	// everyone who is linked to this table!
 
+	if keepsOwnership(modelObj) {
+		return modelObj, nil
+	}
+
 	// stmt := fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND model_id = ? AND role = ?", mdl.GetJoinTableName(modelObjOwnership))
 	tableName := registry.OwnershipTableNameFromOwnershipResourceTypeString(typeString)
 	stmt := fmt.Sprintf("DELETE FROM %s WHERE model_id = ?", tableName)
@@ -145,6 +149,10 @@ func (serv *OwnershipService) HookBeforeDeleteOne(db *gorm.DB, who mdlutil.UserI
 // it with UUID or when we have role
 func (serv *OwnershipService) HookBeforeDeleteMany(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObjs []mdl.IModel) ([]mdl.IModel, error) {
 	for _, modelObj := range modelObjs {
+		if keepsOwnership(modelObj) {
+			continue
+		}
+
 		// Also remove entries from ownership table
 		// Maybe getting table
 		tableName := registry.OwnershipTableNameFromOwnershipResourceTypeString(typeString)
@@ -157,6 +165,13 @@ func (serv *OwnershipService) HookBeforeDeleteMany(db *gorm.DB, who mdlutil.User
 	return modelObjs, nil
 }
 
+// keepsOwnership is true when modelObj is only going to be soft-deleted. The links are kept, since
+// reading it with includeDeleted, restoring and purging it all join the ownership table. They're
+// removed when it's deleted for real or purged (when it's already soft-deleted).
+func keepsOwnership(modelObj mdl.IModel) bool {
+	return !modelNeedsRealDelete(modelObj) && gormfixes.DeletedAt(modelObj) == nil
+}
+
 // CreateOneCore creates the stuff
 func (serv *OwnershipService) CreateOneCore(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObj mdl.IModel, id *datatype.UUID, oldModelObj mdl.IModel) (mdl.IModel, error) {
 	// It looks like I need to explicitly call create here
@@ -194,6 +209,31 @@ func (serv *OwnershipService) CreateOneCore(db *gorm.DB, who mdlutil.UserIDFetch
 	return modelObj, nil
 }
 
+// CreateManyCore creates the models, their pegged models and the ownership rows with multi-row INSERTs
+func (serv *OwnershipService) CreateManyCore(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, modelObjs []mdl.IModel) ([]mdl.IModel, error) {
+	links := make([]interface{}, len(modelObjs))
+	for i, modelObj := range modelObjs {
+		o := reflect.ValueOf(modelObj).Elem().FieldByName("Ownerships")
+		g, _ := o.Index(0).Addr().Interface().(mdlutil.ILinker)
+
+		// In case ID gets overridden in the "before" hookpoint, set it again
+		g.SetModelID(modelObj.GetID())
+		links[i] = g
+	}
+
+	if err := gormfixes.BulkCreateModelsAndPeg(db, modelObjs); err != nil {
+		return nil, err
+	}
+
+	// Create ownership table
+	tableName := registry.OwnershipTableNameFromOwnershipResourceTypeString(typeString)
+	if err := gormfixes.BulkInsert(db, tableName, links); err != nil {
+		return nil, err
+	}
+
+	return modelObjs, nil
+}
+
 // ReadOneCore get one model object based on its type and its id string
 func (serv *OwnershipService) ReadOneCore(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string, id *datatype.UUID, options map[urlparam.Param]interface{}) (mdl.IModel, userrole.UserRole, error) {
 	modelObj := registry.NewFromTypeString(typeString)
@@ -315,8 +355,10 @@ func (serv *OwnershipService) GetAllRolesCore(dbChained *gorm.DB, dbClean *gorm.
 	// role := userrole.UserRoleAdmin // just some default
 	// The difference between this method and the find is that it's missing the
 	// WHERE "model"."deleted_at" IS NULL, so we need to add it
-	if err = dbChained.Where(fmt.Sprintf("\"%s\".\"deleted_at\" IS NULL", rtable)).
-		Select(fmt.Sprintf("\"%s\".\"role\"", joinTableName)).Scan(&res).Error; err != nil {
+	if !includeDeleted(dbChained) {
+		dbChained = dbChained.Where(fmt.Sprintf("\"%s\".\"deleted_at\" IS NULL", rtable))
+	}
+	if err = dbChained.Select(fmt.Sprintf("\"%s\".\"role\"", joinTableName)).Scan(&res).Error; err != nil {
 		return nil, err
 	}
 
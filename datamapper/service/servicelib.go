@@ -1,13 +1,25 @@
 package service
 
 import (
+	"fmt"
 	"reflect"
 
+	"github.com/jinzhu/gorm"
+	"github.com/t2wu/betterrest/hook/userrole"
 	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/betterrest/model/mappertype"
 	"github.com/t2wu/betterrest/registry"
 	"github.com/t2wu/qry/mdl"
 )
 
+// KeyIncludeDeleted is set on the db (with db.Set) when soft-deleted records are read as well
+const KeyIncludeDeleted = "betterrest:include_deleted"
+
+func includeDeleted(db *gorm.DB) bool {
+	v, ok := db.Get(KeyIncludeDeleted)
+	return ok && v == true
+}
+
 func modelNeedsRealDelete(modelObj mdl.IModel) bool {
 	// real delete by default
 	realDelete := true
@@ -32,3 +44,49 @@ func getModelTableNameAndJoinTableNameFromTypeString(typeString string) (string,
 	modelTableName := registry.GetTableNameFromTypeString(typeString)
 	return modelTableName, joinTableName, nil
 }
+
+// roleTableName is the table with the user's role to the records of typeString (the ownership
+// table, or the organization's), "" if there isn't one
+func roleTableName(typeString string) string {
+	switch registry.ModelRegistry[typeString].Mapper {
+	case mappertype.DirectOwnership:
+		_, joinTableName, _ := getModelTableNameAndJoinTableNameFromTypeString(typeString)
+		return joinTableName
+	case mappertype.UnderOrg, mappertype.UnderOrgPartition:
+		return orgJoinTableName(typeString)
+	}
+	return ""
+}
+
+// RolesOfUser returns the roles the user has to any record of typeString, without looking
+// at which records a query would find
+func RolesOfUser(db *gorm.DB, who mdlutil.UserIDFetchable, typeString string) ([]userrole.UserRole, error) {
+	switch registry.ModelRegistry[typeString].Mapper {
+	case mappertype.Global:
+		return []userrole.UserRole{userrole.UserRolePublic}, nil
+	case mappertype.LinkTable:
+		return []userrole.UserRole{userrole.UserRoleInvalid}, nil
+	}
+
+	tableName := roleTableName(typeString)
+	if tableName == "" {
+		return nil, nil
+	}
+
+	roles := make([]userrole.UserRole, 0)
+	if err := db.Table(tableName).Where("user_id = ?", who.GetUserID()).Pluck("DISTINCT role", &roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// DeletedOnlyOfAdminWhere is the condition for reading with includeDeleted: a deleted record
+// only if the user is its admin
+func DeletedOnlyOfAdminWhere(typeString string) (string, []interface{}) {
+	rtable := registry.GetTableNameFromTypeString(typeString)
+	if tableName := roleTableName(typeString); tableName != "" {
+		return fmt.Sprintf(`"%s"."deleted_at" IS NULL OR "%s"."role" = ?`, rtable, tableName),
+			[]interface{}{userrole.UserRoleAdmin}
+	}
+	return fmt.Sprintf(`"%s"."deleted_at" IS NULL`, rtable), nil
+}
@@ -125,6 +125,12 @@ func (mapper *UserMapper) ReadOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPo
 
 	fetcher := hfetcher.NewHandlerFetcher(registry.ModelRegistry[ep.TypeString].HandlerMap, &initData)
 
+	if found, retErr := beforeQueryAllowsOne(fetcher, db, ep, id); retErr != nil {
+		return nil, 0, retErr
+	} else if !found {
+		return nil, 0, &webrender.RetError{Error: gorm.ErrRecordNotFound} // as if ReadOneCore didn't find it
+	}
+
 	// fetch all handlers with before hooks
 	for _, hdlr := range fetcher.FetchHandlersForOpAndHook(ep.Op, "A") {
 		if retErr := hdlr.(hook.IAfter).After(&data, ep); retErr != nil {
@@ -421,6 +427,26 @@ func (mapper *UserMapper) ReadMany(db *gorm.DB, ep *hook.EndPoint, cargo *hook.C
 	return nil, nil, nil, webrender.NewRetValWithError(fmt.Errorf("not implemented"))
 }
 
+// ReadDistinct :-
+func (mapper *UserMapper) ReadDistinct(db *gorm.DB, field string, ep *hook.EndPoint, cargo *hook.Cargo) ([]DistinctValue, *webrender.RetError) {
+	return nil, webrender.NewRetValWithError(fmt.Errorf("not implemented"))
+}
+
+// RestoreOne :-
+func (mapper *UserMapper) RestoreOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	return nil, webrender.NewRetValWithError(fmt.Errorf("not implemented"))
+}
+
+// PurgeOne :-
+func (mapper *UserMapper) PurgeOne(db *gorm.DB, id *datatype.UUID, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
+	return nil, webrender.NewRetValWithError(fmt.Errorf("not implemented"))
+}
+
+// ModelsExist :-
+func (mapper *UserMapper) ModelsExist(db *gorm.DB, modelObjs []mdl.IModel, ep *hook.EndPoint) ([]bool, []bool, *webrender.RetError) {
+	return nil, nil, webrender.NewRetValWithError(fmt.Errorf("not implemented"))
+}
+
 // UpdateMany :-
 func (mapper *UserMapper) UpdateMany(db *gorm.DB,
 	modelObjs []mdl.IModel, ep *hook.EndPoint, cargo *hook.Cargo) (*MapperRet, *webrender.RetError) {
@@ -0,0 +1,361 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/userrole"
+	"github.com/t2wu/betterrest/libs/webrender"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/mdl"
+)
+
+// Shared is the store used by Handler when no store is given in Registrar's Hook()
+var Shared = NewLRU(10000, time.Minute)
+
+var (
+	storesMu sync.Mutex
+	stores   []*LRU // all stores, to be invalidated on write
+)
+
+// Invalidate removes the cached entries of typeString in all stores, and those of the types which
+// embed it (such as a parent read with its children preloaded).
+// The lifecycle functions call it once a write has been committed.
+func Invalidate(typeString string) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	for _, store := range stores {
+		store.InvalidateType(typeString)
+	}
+}
+
+// InvalidateAll empties all stores, for when writes may have been missed
+func InvalidateAll() {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	for _, store := range stores {
+		store.Clear()
+	}
+}
+
+// entry is what's cached for a read
+type entry struct {
+	key        string
+	typeString string
+	nested     map[string]bool // other registered types in the models, such as preloaded children
+	expireAt   time.Time
+
+	found bool
+	ms    []mdl.IModel
+	roles []userrole.UserRole
+	no    *int
+}
+
+// LRU is an in-process cache, the least recently used entry is evicted when it's full.
+// Entries also expire after ttl (no expiration if ttl is 0). It's safe for concurrent use.
+type LRU struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List               // front is the most recently used
+	items    map[string]*list.Element // key -> element with *entry
+}
+
+// NewLRU creates a store with capacity entries
+func NewLRU(capacity int, ttl time.Duration) *LRU {
+	l := &LRU{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+
+	storesMu.Lock()
+	stores = append(stores, l)
+	storesMu.Unlock()
+	return l
+}
+
+func (l *LRU) get(key string) (*entry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := elem.Value.(*entry)
+	if l.ttl > 0 && time.Now().After(e.expireAt) {
+		l.remove(elem)
+		return nil, false
+	}
+
+	l.ll.MoveToFront(elem)
+	return e, true
+}
+
+func (l *LRU) add(e *entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.expireAt = time.Now().Add(l.ttl)
+	if elem, ok := l.items[e.key]; ok {
+		elem.Value = e
+		l.ll.MoveToFront(elem)
+		return
+	}
+
+	l.items[e.key] = l.ll.PushFront(e)
+	for l.capacity > 0 && l.ll.Len() > l.capacity {
+		l.remove(l.ll.Back())
+	}
+}
+
+// InvalidateType removes all entries of typeString, and those with typeString nested in the models
+func (l *LRU) InvalidateType(typeString string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for elem := l.ll.Front(); elem != nil; {
+		next := elem.Next()
+		if e := elem.Value.(*entry); e.typeString == typeString || e.nested[typeString] {
+			l.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// Clear removes all entries
+func (l *LRU) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ll.Init()
+	l.items = make(map[string]*list.Element)
+}
+
+// Len is the number of entries, expired ones included
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ll.Len()
+}
+
+func (l *LRU) remove(elem *list.Element) {
+	l.ll.Remove(elem)
+	delete(l.items, elem.Value.(*entry).key)
+}
+
+// Handler is an ICache hook which caches reads in an LRU store. Register it for R, for example
+//
+//	Hook(&cache.Handler{}, "R")                              // uses cache.Shared
+//	Hook(&cache.Handler{}, "R", cache.NewLRU(500, time.Hour)) // own store
+//
+// Reads are cached per type, user, URL and URL parameters, and entries of a type are removed when
+// a write to it (or to a type nested in it) has been committed. The models are copied in and out
+// of the cache, so callers can modify theirs.
+type Handler struct {
+	store *LRU
+}
+
+// Init takes the store if there is one in args
+func (h *Handler) Init(data *hook.InitData, args ...interface{}) {
+	h.store = Shared
+	if len(args) > 0 {
+		if store, ok := args[0].(*LRU); ok {
+			h.store = store
+		}
+	}
+}
+
+// GetFromCache returns the cached read if there is one
+func (h *Handler) GetFromCache(ep *hook.EndPoint) (handled bool, found bool, ms []mdl.IModel, roles []userrole.UserRole, no *int, retErr *webrender.RetError) {
+	key, err := cacheKey(ep)
+	if err != nil {
+		return false, false, nil, nil, nil, nil // just don't cache
+	}
+
+	e, ok := h.store.get(key)
+	if !ok {
+		return false, false, nil, nil, nil, nil
+	}
+
+	var n *int
+	if e.no != nil {
+		n = new(int)
+		*n = *e.no
+	}
+	return true, e.found, copyModels(e.ms), append([]userrole.UserRole{}, e.roles...), n, nil
+}
+
+// AddToCache caches the read
+func (h *Handler) AddToCache(ep *hook.EndPoint, found bool, ms []mdl.IModel, roles []userrole.UserRole, no *int) (handled bool, retErr *webrender.RetError) {
+	key, err := cacheKey(ep)
+	if err != nil {
+		return false, nil
+	}
+
+	e := &entry{
+		key:        key,
+		typeString: ep.TypeString,
+		nested:     nestedTypeStrings(ep.TypeString),
+		found:      found,
+		ms:         copyModels(ms),
+		roles:      append([]userrole.UserRole{}, roles...),
+	}
+	if no != nil {
+		e.no = new(int)
+		*e.no = *no
+	}
+
+	h.store.add(e)
+	return true, nil
+}
+
+// cacheKey is type, user, cardinality, path, the query string and the parsed URL parameters.
+// The query string is there for parameters which aren't parsed (such as CustomURLParams), and
+// the parsed ones for those set without being in the URL. Both have the keys sorted so the
+// order in the URL doesn't matter.
+func cacheKey(ep *hook.EndPoint) (string, error) {
+	params, err := json.Marshal(ep.URLParams)
+	if err != nil {
+		return "", err
+	}
+
+	who := ""
+	if ep.Who != nil && ep.Who.GetUserID() != nil {
+		who = ep.Who.GetUserID().String()
+	}
+
+	u, err := url.Parse(ep.URL)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s|%s|%v|%s|%s|%s", ep.TypeString, who, ep.Cardinality, u.Path, u.Query().Encode(), params), nil
+}
+
+// nestedTypeStrings are the other registered types found in the fields of typeString's model
+func nestedTypeStrings(typeString string) map[string]bool {
+	reg, ok := registry.ModelRegistry[typeString]
+	if !ok || reg.Typ == nil {
+		return nil
+	}
+
+	typeStrings := make(map[reflect.Type][]string)
+	for ts, reg2 := range registry.ModelRegistry {
+		if ts != typeString && reg2.Typ != nil {
+			typeStrings[reg2.Typ] = append(typeStrings[reg2.Typ], ts)
+		}
+	}
+
+	nested := make(map[string]bool)
+	seen := make(map[reflect.Type]bool)
+	var walk func(typ reflect.Type)
+	walk = func(typ reflect.Type) {
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct || seen[typ] {
+			return
+		}
+		seen[typ] = true
+
+		for _, ts := range typeStrings[typ] {
+			nested[ts] = true
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			walk(typ.Field(i).Type)
+		}
+	}
+	walk(reg.Typ)
+	return nested
+}
+
+// copyModels deep copies the models, so the cache and its callers don't share them.
+// Unexported fields are copied as they are.
+func copyModels(ms []mdl.IModel) []mdl.IModel {
+	copied := make([]mdl.IModel, len(ms))
+	seen := make(map[copiedPtr]reflect.Value)
+	for i, m := range ms {
+		if m != nil {
+			copied[i] = copyValue(reflect.ValueOf(m), seen).Interface().(mdl.IModel)
+		}
+	}
+	return copied
+}
+
+// copiedPtr is a pointer already copied, so that one pointed to twice (or in a cycle) is copied once
+type copiedPtr struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+func copyValue(v reflect.Value, seen map[copiedPtr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		key := copiedPtr{ptr: v.Pointer(), typ: v.Type()}
+		if c, ok := seen[key]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		seen[key] = c
+		c.Elem().Set(copyValue(v.Elem(), seen))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyValue(v.Field(i), seen))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+	case reflect.Array:
+		if k := v.Type().Elem().Kind(); k <= reflect.Complex128 || k == reflect.String {
+			return v // such as UUIDs, copied with the value
+		}
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), copyValue(iter.Value(), seen))
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem(), seen))
+		return c
+	default:
+		return v
+	}
+}
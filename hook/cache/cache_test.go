@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/hook/userrole"
+	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/model/mappertype"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/mdl"
+)
+
+type doorModel struct {
+	mdl.BaseModel
+	Name string `json:"name"`
+}
+
+type siteModel struct {
+	mdl.BaseModel
+	Name  string       `json:"name"`
+	Doors []*doorModel `json:"doors" betterrest:"peg"`
+}
+
+func newEp(typeString string, limit int) *hook.EndPoint {
+	return &hook.EndPoint{
+		TypeString:  typeString,
+		URL:         "/" + typeString + "?limit=10",
+		Op:          rest.OpRead,
+		Cardinality: rest.CardinalityMany,
+		URLParams:   map[urlparam.Param]interface{}{urlparam.ParamLimit: limit},
+	}
+}
+
+func newHandler(store *LRU) *Handler {
+	h := &Handler{}
+	h.Init(&hook.InitData{}, store)
+	return h
+}
+
+func TestHandler_AddToCacheThenGetFromCache(t *testing.T) {
+	h := newHandler(NewLRU(10, time.Minute))
+	ep := newEp("Site", 10)
+
+	handled, _, _, _, _, _ := h.GetFromCache(ep)
+	assert.False(t, handled)
+
+	no := 1
+	ms := []mdl.IModel{&mdl.BaseModel{}}
+	handled, retErr := h.AddToCache(ep, true, ms, []userrole.UserRole{userrole.UserRoleAdmin}, &no)
+	assert.True(t, handled)
+	assert.Nil(t, retErr)
+
+	handled, found, ms2, roles2, no2, retErr := h.GetFromCache(ep)
+	assert.True(t, handled)
+	assert.True(t, found)
+	assert.Nil(t, retErr)
+	assert.Equal(t, ms, ms2)
+	assert.Equal(t, []userrole.UserRole{userrole.UserRoleAdmin}, roles2)
+	assert.Equal(t, 1, *no2)
+
+	// different parameters is a different entry
+	handled, _, _, _, _, _ = h.GetFromCache(newEp("Site", 20))
+	assert.False(t, handled)
+}
+
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewLRU(2, 0)
+	store.add(&entry{key: "a", typeString: "Site"})
+	store.add(&entry{key: "b", typeString: "Site"})
+
+	_, ok := store.get("a") // now b is the least recently used
+	assert.True(t, ok)
+
+	store.add(&entry{key: "c", typeString: "Site"})
+	assert.Equal(t, 2, store.Len())
+
+	_, ok = store.get("b")
+	assert.False(t, ok)
+	_, ok = store.get("a")
+	assert.True(t, ok)
+	_, ok = store.get("c")
+	assert.True(t, ok)
+}
+
+func TestLRU_Expires(t *testing.T) {
+	store := NewLRU(10, time.Millisecond)
+	store.add(&entry{key: "a", typeString: "Site"})
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok := store.get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, store.Len())
+}
+
+func TestInvalidate_OnlyRemovesTheType(t *testing.T) {
+	store := NewLRU(10, time.Minute)
+	store.add(&entry{key: "a", typeString: "Site"})
+	store.add(&entry{key: "b", typeString: "Door"})
+
+	Invalidate("Site")
+
+	_, ok := store.get("a")
+	assert.False(t, ok)
+	_, ok = store.get("b")
+	assert.True(t, ok)
+}
+
+func TestHandler_GetFromCache_ReturnsCopies(t *testing.T) {
+	h := newHandler(NewLRU(10, time.Minute))
+	ep := newEp("Site", 10)
+
+	site := &siteModel{Name: "HQ", Doors: []*doorModel{{Name: "Front"}}}
+	h.AddToCache(ep, true, []mdl.IModel{site}, []userrole.UserRole{userrole.UserRoleAdmin}, nil)
+	site.Doors[0].Name = "Changed after caching"
+
+	_, _, ms, _, _, _ := h.GetFromCache(ep)
+	ms[0].(*siteModel).Doors[0].Name = "Changed by a caller"
+
+	_, _, ms2, _, _, _ := h.GetFromCache(ep)
+	assert.Equal(t, "Front", ms2[0].(*siteModel).Doors[0].Name)
+}
+
+func TestHandler_CustomURLParamsAreInTheKey(t *testing.T) {
+	h := newHandler(NewLRU(10, time.Minute))
+	ep := newEp("Site", 10)
+	ep.URL = "/Site?limit=10&interpolate=true"
+	h.AddToCache(ep, true, []mdl.IModel{}, []userrole.UserRole{}, nil)
+
+	ep2 := newEp("Site", 10)
+	ep2.URL = "/Site?interpolate=false&limit=10"
+	handled, _, _, _, _, _ := h.GetFromCache(ep2)
+	assert.False(t, handled)
+
+	ep2.URL = "/Site?interpolate=true&limit=10" // order doesn't matter
+	handled, _, _, _, _, _ = h.GetFromCache(ep2)
+	assert.True(t, handled)
+}
+
+func TestInvalidate_RemovesTheTypesEmbeddingIt(t *testing.T) {
+	delete(registry.ModelRegistry, "CacheSites")
+	delete(registry.ModelRegistry, "CacheDoors")
+	opt := registry.RegOptions{BatchMethods: "R", Mapper: mappertype.Global}
+	registry.For("CacheSites").ModelWithOption(&siteModel{}, opt)
+	registry.For("CacheDoors").ModelWithOption(&doorModel{}, opt)
+	defer delete(registry.ModelRegistry, "CacheSites")
+	defer delete(registry.ModelRegistry, "CacheDoors")
+
+	h := newHandler(NewLRU(10, time.Minute))
+	h.AddToCache(newEp("CacheSites", 10), true, []mdl.IModel{}, []userrole.UserRole{}, nil)
+	h.AddToCache(newEp("CacheDoors", 10), true, []mdl.IModel{}, []userrole.UserRole{}, nil)
+
+	Invalidate("CacheDoors")
+
+	handled, _, _, _, _, _ := h.GetFromCache(newEp("CacheSites", 10))
+	assert.False(t, handled)
+	handled, _, _, _, _, _ = h.GetFromCache(newEp("CacheDoors", 10))
+	assert.False(t, handled)
+}
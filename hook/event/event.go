@@ -0,0 +1,176 @@
+package event
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// Event is a committed write. Published by the lifecycle functions after AfterTransact.
+type Event struct {
+	TypeString  string
+	Op          rest.Op
+	Cardinality rest.Cardinality
+	URL         string
+	IDs         []*datatype.UUID
+	Ms          []mdl.IModel // for delete and purge the records as they were
+	OldMs       []mdl.IModel // records before the write, for update, patch, delete, restore and purge
+	Who         mdlutil.UserIDFetchable
+}
+
+// Subscription is returned by Subscribe and SubscribeAsync
+type Subscription struct {
+	typeString string
+	ops        []rest.Op
+	fn         func(e *Event)
+	ch         chan *Event // for SubscribeAsync
+	done       chan struct{}
+	chMu       sync.Mutex // so the channel isn't closed while sending
+	closed     bool
+}
+
+var (
+	mu            sync.RWMutex
+	subscriptions = make([]*Subscription, 0)
+)
+
+// Subscribe calls fn after every committed write of typeString ("" for any type) with one of the ops
+// (any op if none is given). It's called in the goroutine of the request before the response is sent,
+// so it should be quick. The models are the ones of the request, don't modify them.
+func Subscribe(typeString string, fn func(e *Event), ops ...rest.Op) *Subscription {
+	sub := &Subscription{typeString: typeString, ops: ops, fn: fn}
+	add(sub)
+	return sub
+}
+
+// SubscribeAsync is Subscribe but fn is called from a goroutine of its own, with up to buffer events
+// waiting. Events are dropped (and logged) when the buffer is full, so the write isn't held up.
+func SubscribeAsync(typeString string, buffer int, fn func(e *Event), ops ...rest.Op) *Subscription {
+	sub := &Subscription{
+		typeString: typeString,
+		ops:        ops,
+		fn:         fn,
+		ch:         make(chan *Event, buffer),
+		done:       make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		for e := range sub.ch {
+			sub.call(e)
+		}
+	}()
+	add(sub)
+	return sub
+}
+
+// Unsubscribe stops the events. For SubscribeAsync it waits for the events in the buffer.
+func (sub *Subscription) Unsubscribe() {
+	mu.Lock()
+	found := false
+	for i, s := range subscriptions {
+		if s == sub {
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			found = true
+			break
+		}
+	}
+	mu.Unlock()
+
+	if found && sub.ch != nil {
+		sub.chMu.Lock()
+		sub.closed = true
+		close(sub.ch)
+		sub.chMu.Unlock()
+		<-sub.done
+	}
+}
+
+// Publish sends the event of this write to the subscribers
+func Publish(ep *hook.EndPoint, ms []mdl.IModel, oldMs []mdl.IModel) {
+	mu.RLock()
+	subs := append([]*Subscription{}, subscriptions...) // a subscriber may subscribe or unsubscribe
+	mu.RUnlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	e := &Event{
+		TypeString:  ep.TypeString,
+		Op:          ep.Op,
+		Cardinality: ep.Cardinality,
+		URL:         ep.URL,
+		IDs:         make([]*datatype.UUID, 0, len(ms)),
+		Ms:          ms,
+		OldMs:       oldMs,
+		Who:         ep.Who,
+	}
+	for _, m := range ms {
+		if m != nil {
+			e.IDs = append(e.IDs, m.GetID())
+		}
+	}
+
+	for _, sub := range subs {
+		if !sub.wants(e) {
+			continue
+		}
+
+		if sub.ch == nil {
+			sub.call(e)
+		} else {
+			sub.send(e)
+		}
+	}
+}
+
+func add(sub *Subscription) {
+	mu.Lock()
+	defer mu.Unlock()
+	subscriptions = append(subscriptions, sub)
+}
+
+func (sub *Subscription) wants(e *Event) bool {
+	if sub.typeString != "" && sub.typeString != e.TypeString {
+		return false
+	}
+	if len(sub.ops) == 0 {
+		return true
+	}
+	for _, op := range sub.ops {
+		if op == e.Op {
+			return true
+		}
+	}
+	return false
+}
+
+func (sub *Subscription) send(e *Event) {
+	sub.chMu.Lock()
+	defer sub.chMu.Unlock()
+	if sub.closed {
+		return
+	}
+
+	select {
+	case sub.ch <- e:
+	default:
+		log.Printf("event: buffer full, dropped op %d of %s\n", e.Op, e.TypeString)
+	}
+}
+
+// call recovers from a panic of a subscriber, since the write is already committed
+func (sub *Subscription) call(e *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("event: subscriber panicked on op %d of %s: %v\n", e.Op, e.TypeString, r)
+			debug.PrintStack()
+		}
+	}()
+	sub.fn(e)
+}
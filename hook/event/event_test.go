@@ -0,0 +1,56 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+)
+
+func TestSubscribe_OnlyGetsTheTypeAndOps(t *testing.T) {
+	got := make([]rest.Op, 0)
+	sub := Subscribe("Lock", func(e *Event) {
+		got = append(got, e.Op)
+	}, rest.OpCreate, rest.OpDelete)
+	defer sub.Unsubscribe()
+
+	Publish(&hook.EndPoint{TypeString: "Lock", Op: rest.OpCreate}, nil, nil)
+	Publish(&hook.EndPoint{TypeString: "Lock", Op: rest.OpUpdate}, nil, nil)
+	Publish(&hook.EndPoint{TypeString: "Door", Op: rest.OpDelete}, nil, nil)
+	Publish(&hook.EndPoint{TypeString: "Lock", Op: rest.OpDelete}, nil, nil)
+
+	assert.Equal(t, []rest.Op{rest.OpCreate, rest.OpDelete}, got)
+}
+
+func TestSubscribeAsync_GetsEventsAndUnsubscribeWaits(t *testing.T) {
+	got := make([]string, 0)
+	sub := SubscribeAsync("", 10, func(e *Event) {
+		time.Sleep(time.Millisecond)
+		got = append(got, e.TypeString)
+	})
+
+	Publish(&hook.EndPoint{TypeString: "Lock", Op: rest.OpCreate}, nil, nil)
+	Publish(&hook.EndPoint{TypeString: "Door", Op: rest.OpPatch}, nil, nil)
+	sub.Unsubscribe()
+	Publish(&hook.EndPoint{TypeString: "Lock", Op: rest.OpCreate}, nil, nil)
+
+	assert.Equal(t, []string{"Lock", "Door"}, got)
+}
+
+func TestSubscribe_PanicDoesNotStopOtherSubscribers(t *testing.T) {
+	sub1 := Subscribe("", func(e *Event) {
+		panic("oops")
+	})
+	defer sub1.Unsubscribe()
+
+	called := false
+	sub2 := Subscribe("", func(e *Event) {
+		called = true
+	})
+	defer sub2.Unsubscribe()
+
+	Publish(&hook.EndPoint{TypeString: "Lock", Op: rest.OpCreate}, nil, nil)
+	assert.True(t, called)
+}
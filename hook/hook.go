@@ -1,6 +1,9 @@
 package hook
 
 import (
+	"encoding/json"
+	"reflect"
+
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/t2wu/betterrest/hook/rest"
@@ -42,6 +45,58 @@ type Data struct {
 	Cargo *Cargo
 	// Role of this user in relation to this data, only available during read
 	Roles []userrole.UserRole
+	// OldMs are the records before the write, aligned with Ms. Only for update, patch, delete,
+	// restore and purge (for the last three they're the loaded records, so the same as Ms).
+	OldMs []mdl.IModel
+}
+
+// ChangedFields returns the JSON fields of Ms[i] which differ from OldMs[i], with the new values
+// (nil if it's no longer there). Everything is changed if there is no old one.
+func (data *Data) ChangedFields(i int) (map[string]interface{}, error) {
+	var oldModelObj mdl.IModel
+	if i < len(data.OldMs) {
+		oldModelObj = data.OldMs[i]
+	}
+	return ChangedFields(oldModelObj, data.Ms[i])
+}
+
+// ChangedFields returns the JSON fields of modelObj which differ from oldModelObj, with the new
+// values. Either one can be nil.
+func ChangedFields(oldModelObj, modelObj mdl.IModel) (map[string]interface{}, error) {
+	oldFields, err := jsonFields(oldModelObj)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := jsonFields(modelObj)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]interface{})
+	for k, v := range newFields {
+		if v2, ok := oldFields[k]; !ok || !reflect.DeepEqual(v, v2) {
+			changed[k] = v
+		}
+	}
+	for k := range oldFields {
+		if _, ok := newFields[k]; !ok {
+			changed[k] = nil
+		}
+	}
+	return changed, nil
+}
+
+func jsonFields(modelObj mdl.IModel) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if v := reflect.ValueOf(modelObj); !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return fields, nil
+	}
+
+	b, err := json.Marshal(modelObj)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(b, &fields)
 }
 
 // Endpoint information
@@ -101,12 +156,29 @@ type ICache interface {
 	AddToCache(ep *EndPoint, found bool, ms []mdl.IModel, roles []userrole.UserRole, no *int) (handled bool, retErr *webrender.RetError)
 }
 
+// IBeforeQuery is called for reads (ReadMany, ReadOne and distinct) before the query is run, after
+// it's limited to what the user can access. Predicates, joins and ordering can be added to db and
+// the returned one is used for the query, including the total count. Qualify columns with the table
+// name since there may be joins. Not called if ICache handled the read.
+type IBeforeQuery interface {
+	BeforeQuery(db *gorm.DB, ep *EndPoint) (*gorm.DB, *webrender.RetError)
+}
+
 // IAfterTransact is the method to be called after data is after the entire database
 // transaction is done. No error is returned because database transaction is already committed.
 type IAfterTransact interface {
 	AfterTransact(data *Data, ep *EndPoint)
 }
 
+// IAfterTransactAsync is like IAfterTransact but called by a worker of hook/outbox, so it doesn't hold
+// up the response. The call is written to an outbox table in the transaction, so it survives a crash,
+// and retried while an error is returned. The handler is instantiated again by the worker: it doesn't
+// share state with the request, and data has only Ms, OldMs and Roles (models as they're in JSON).
+// ep has no URLParams and Who only has the user ID.
+type IAfterTransactAsync interface {
+	AfterTransactAsync(data *Data, ep *EndPoint) error
+}
+
 // IRender is for formatting IModel with a custom function
 // basically do your own custom output
 // If return false, use the default JSON output
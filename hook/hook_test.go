@@ -0,0 +1,32 @@
+package hook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2wu/qry/mdl"
+)
+
+type lock struct {
+	mdl.BaseModel
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+}
+
+func TestData_ChangedFields(t *testing.T) {
+	data := Data{
+		OldMs: []mdl.IModel{&lock{Name: "front", Schedule: "9-5"}},
+		Ms:    []mdl.IModel{&lock{Name: "front", Schedule: "8-6"}},
+	}
+
+	changed, err := data.ChangedFields(0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"schedule": "8-6"}, changed)
+}
+
+func TestChangedFields_NoOldModel(t *testing.T) {
+	changed, err := ChangedFields(nil, &lock{Name: "front"})
+	assert.Nil(t, err)
+	assert.Equal(t, "front", changed["name"])
+	assert.Contains(t, changed, "schedule")
+}
@@ -0,0 +1,107 @@
+package inject
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/t2wu/betterrest/libs/gotag"
+)
+
+var (
+	mu       sync.RWMutex
+	services = make(map[reflect.Type]reflect.Value)
+)
+
+// Provide registers svc for the hook fields of the interface iface points to. Providing it again
+// replaces it. Fields to be injected are exported and tagged betterrest:"inject".
+//
+//	type CreateLockStatus struct {
+//		Locks LockStore `betterrest:"inject"`
+//	}
+//
+//	inject.Provide((*lockhandler.LockStore)(nil), &dbservice.Lock{})
+func Provide(iface interface{}, svc interface{}) {
+	typ := reflect.TypeOf(iface)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Interface {
+		panic(fmt.Sprintf("inject.Provide needs a pointer to an interface, e.g. (*Store)(nil), not %v", typ))
+	}
+	typ = typ.Elem()
+
+	v := reflect.ValueOf(svc)
+	if !v.IsValid() || !v.Type().Implements(typ) {
+		panic(fmt.Sprintf("%v doesn't implement %v", reflect.TypeOf(svc), typ))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	services[typ] = v
+}
+
+// Reset removes all services, for tests
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	services = make(map[reflect.Type]reflect.Value)
+}
+
+// Into sets the fields of hdlr, a pointer to a struct, which are tagged betterrest:"inject"
+func Into(hdlr interface{}) error {
+	v := reflect.ValueOf(hdlr)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil // nothing to inject into
+	}
+	v = v.Elem()
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, i := range injectedFields(v.Type()) {
+		if err := checkField(v.Type(), i); err != nil {
+			return err
+		}
+		v.Field(i).Set(services[v.Type().Field(i).Type])
+	}
+	return nil
+}
+
+// Check returns an error if a field of the struct type typ tagged betterrest:"inject" can't be set,
+// so it's found at startup rather than at the first request
+func Check(typ reflect.Type) error {
+	if typ.Kind() != reflect.Struct {
+		return nil
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, i := range injectedFields(typ) {
+		if err := checkField(typ, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkField is called with mu held
+func checkField(typ reflect.Type, i int) error {
+	field := typ.Field(i)
+	if field.PkgPath != "" {
+		return fmt.Errorf("%v.%s: injected field has to be exported", typ, field.Name)
+	}
+	if field.Type.Kind() != reflect.Interface {
+		return fmt.Errorf("%v.%s: injected field has to be an interface", typ, field.Name)
+	}
+	if _, ok := services[field.Type]; !ok {
+		return fmt.Errorf("%v.%s: nothing provided for %v", typ, field.Name, field.Type)
+	}
+	return nil
+}
+
+func injectedFields(typ reflect.Type) []int {
+	indices := make([]int, 0)
+	for i := 0; i < typ.NumField(); i++ {
+		if gotag.TagValueHasPrefix(typ.Field(i).Tag.Get("betterrest"), "inject") {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
@@ -0,0 +1,46 @@
+package inject
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type store interface {
+	Name() string
+}
+
+type dbStore struct{}
+
+func (s *dbStore) Name() string {
+	return "db"
+}
+
+type hookWithStore struct {
+	Store store `betterrest:"inject"`
+	Other string
+}
+
+func TestInto_SetsTaggedFields(t *testing.T) {
+	Reset()
+	defer Reset()
+	Provide((*store)(nil), &dbStore{})
+
+	hdlr := &hookWithStore{}
+	if assert.Nil(t, Into(hdlr)) && assert.NotNil(t, hdlr.Store) {
+		assert.Equal(t, "db", hdlr.Store.Name())
+	}
+	assert.Equal(t, "", hdlr.Other)
+}
+
+func TestCheck_ErrorsWhenNothingProvided(t *testing.T) {
+	Reset()
+	defer Reset()
+
+	assert.NotNil(t, Check(reflect.TypeOf(hookWithStore{})))
+	assert.NotNil(t, Into(&hookWithStore{}))
+
+	Provide((*store)(nil), &dbStore{})
+	assert.Nil(t, Check(reflect.TypeOf(hookWithStore{})))
+}
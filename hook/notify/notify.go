@@ -0,0 +1,166 @@
+package notify
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/t2wu/betterrest/hook/cache"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// maxPayload is under Postgres' limit of 8000 bytes for a notification payload
+const maxPayload = 7900
+
+// Instance identifies this process in the events it publishes
+var Instance = datatype.NewUUID().String()
+
+// Event is what's published on the channel for a committed write
+type Event struct {
+	Instance   string   `json:"instance"`
+	TypeString string   `json:"typeString"`
+	Op         rest.Op  `json:"op"`
+	IDs        []string `json:"ids,omitempty"`
+
+	// Truncated is set when there are too many IDs to fit in a notification, so they're left out
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Resync is set (with nothing else) by Listener after it reconnects, events may have been
+	// missed in between
+	Resync bool `json:"-"`
+}
+
+// Publish notifies settings.NotifyChannel of the write. It's called inside the transaction so
+// Postgres only delivers it when the transaction commits. Does nothing if there is no channel.
+func Publish(tx *gorm.DB, typeString string, op rest.Op, ms []mdl.IModel) error {
+	if settings.NotifyChannel == "" {
+		return nil
+	}
+
+	ev := Event{Instance: Instance, TypeString: typeString, Op: op, IDs: make([]string, 0, len(ms))}
+	for _, m := range ms {
+		if m != nil && m.GetID() != nil {
+			ev.IDs = append(ev.IDs, m.GetID().String())
+		}
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxPayload {
+		ev.IDs, ev.Truncated = nil, true
+		if payload, err = json.Marshal(ev); err != nil {
+			return err
+		}
+	}
+
+	return tx.Exec("SELECT pg_notify(?, ?)", settings.NotifyChannel, string(payload)).Error
+}
+
+type subscriber struct {
+	typeString string
+	fn         func(ev Event)
+}
+
+// Listener LISTENs on the channel and dispatches the events to the subscribers. Start one per
+// instance. Events written by other instances also invalidate hook/cache.
+type Listener struct {
+	dsn     string
+	channel string
+	pql     *pq.Listener
+
+	mu          sync.RWMutex
+	subscribers []subscriber
+}
+
+// NewListener creates a listener on a new connection with dsn (lib/pq format). channel is
+// settings.NotifyChannel if empty.
+func NewListener(dsn, channel string) *Listener {
+	if channel == "" {
+		channel = settings.NotifyChannel
+	}
+
+	l := &Listener{dsn: dsn, channel: channel}
+	l.Subscribe("", func(ev Event) {
+		if ev.Resync {
+			cache.InvalidateAll()
+		} else if ev.Instance != Instance { // ours are invalidated already
+			cache.Invalidate(ev.TypeString)
+		}
+	})
+	return l
+}
+
+// Subscribe calls fn for every event of typeString, or of all types if typeString is empty.
+// fn is called from the listener goroutine so it should not block. Resync events go to all
+// subscribers.
+func (l *Listener) Subscribe(typeString string, fn func(ev Event)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, subscriber{typeString: typeString, fn: fn})
+}
+
+// Start connects and starts dispatching in a goroutine
+func (l *Listener) Start() error {
+	l.pql = pq.NewListener(l.dsn, 10*time.Second, time.Minute, func(t pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("notify listener:", err)
+		}
+	})
+	if err := l.pql.Listen(l.channel); err != nil {
+		l.pql.Close()
+		return err
+	}
+
+	go l.run()
+	return nil
+}
+
+// Close stops listening
+func (l *Listener) Close() error {
+	if l.pql == nil {
+		return nil
+	}
+	return l.pql.Close()
+}
+
+func (l *Listener) run() {
+	for {
+		select {
+		case n, ok := <-l.pql.Notify:
+			if !ok {
+				return // closed
+			}
+			if n == nil { // reconnected
+				l.dispatch(Event{Resync: true})
+				continue
+			}
+
+			ev := Event{}
+			if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+				log.Println("notify listener: bad payload:", err)
+				continue
+			}
+			l.dispatch(ev)
+		case <-time.After(90 * time.Second):
+			go l.pql.Ping() // so that a dead connection is noticed
+		}
+	}
+}
+
+func (l *Listener) dispatch(ev Event) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.subscribers {
+		if ev.Resync || s.typeString == "" || s.typeString == ev.TypeString {
+			s.fn(ev)
+		}
+	}
+}
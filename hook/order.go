@@ -0,0 +1,40 @@
+package hook
+
+import "reflect"
+
+// Ordering can be passed among the args of Registrar's Hook() to order hooks which handle the
+// same hookpoint. It's taken out of the args, Init() doesn't see it.
+//
+//	Hook(&ValidateHook{}, "CU", hook.RunBefore(&NotifyHook{}))
+//	Hook(&AuditHook{}, "CU", hook.Priority(10))
+//
+// RunBefore and RunAfter come first, then priority (higher runs first), then the order of
+// registration.
+type Ordering struct {
+	Priority int
+	Before   []reflect.Type // this hook runs before these
+	After    []reflect.Type // and after these
+}
+
+// Priority runs the hook before those with lower priority, which is 0 if not given
+func Priority(priority int) Ordering {
+	return Ordering{Priority: priority}
+}
+
+// RunBefore runs the hook before the hooks of these types
+func RunBefore(hdlrs ...IHook) Ordering {
+	return Ordering{Before: hookTypes(hdlrs)}
+}
+
+// RunAfter runs the hook after the hooks of these types
+func RunAfter(hdlrs ...IHook) Ordering {
+	return Ordering{After: hookTypes(hdlrs)}
+}
+
+func hookTypes(hdlrs []IHook) []reflect.Type {
+	types := make([]reflect.Type, len(hdlrs))
+	for i, hdlr := range hdlrs {
+		types[i] = reflect.TypeOf(hdlr).Elem()
+	}
+	return types
+}
@@ -0,0 +1,402 @@
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/inject"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/hook/userrole"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/betterrest/registry/handlermap"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+// ErrNotStarted is returned by CheckStarted when there are IAfterTransactAsync hooks but Start
+// hasn't been called
+var ErrNotStarted = errors.New("IAfterTransactAsync hooks need outbox.Start")
+
+// Entry is one call of an IAfterTransactAsync hook, written in the transaction of the write
+type Entry struct {
+	ID        *datatype.UUID `gorm:"type:uuid;primary_key;"`
+	CreatedAt time.Time
+
+	TypeString  string
+	Handler     string // type name of the hook
+	Op          rest.Op
+	Cardinality rest.Cardinality
+	URL         string
+	UserID      *datatype.UUID   `gorm:"type:uuid"`
+	Ms          registry.RawJSON `gorm:"type:jsonb"`
+	OldMs       registry.RawJSON `gorm:"type:jsonb"`
+
+	Attempts      int
+	NextAttemptAt time.Time `sql:"index"` // also when a claim by a worker expires
+	LastError     string
+	FailedAt      *time.Time // gave up after Config.MaxAttempts
+}
+
+// TableName is better_rest_outbox
+func (Entry) TableName() string {
+	return "better_rest_outbox"
+}
+
+// Config is for the worker pool
+type Config struct {
+	Workers      int           // 4 if not given
+	MaxAttempts  int           // 5 if not given
+	Backoff      time.Duration // before the first retry, doubled each time, 1 second if not given
+	MaxBackoff   time.Duration // 5 minutes if not given
+	PollInterval time.Duration // for entries of other instances or left by a crash, 5 seconds if not given
+	Lease        time.Duration // how long a claimed entry is not given to another worker, 5 minutes if not given
+}
+
+type pool struct {
+	db   *gorm.DB
+	cfg  Config
+	wake chan struct{}
+	jobs chan *Entry
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var (
+	mu      sync.Mutex
+	current *pool
+)
+
+// Start creates the outbox table if it's not there and starts the workers. Entries left
+// from before are run as well.
+func Start(db *gorm.DB, cfg Config) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil {
+		return errors.New("outbox already started")
+	}
+
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Second
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = 5 * time.Minute
+	}
+
+	if err := db.AutoMigrate(&Entry{}).Error; err != nil {
+		return err
+	}
+
+	p := &pool{
+		db:   db,
+		cfg:  cfg,
+		wake: make(chan struct{}, 1),
+		jobs: make(chan *Entry),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	p.wg.Add(1)
+	go p.dispatch()
+
+	current = p
+	return nil
+}
+
+// Stop stops the workers after the hooks they're running return. Claimed entries which are
+// not run yet are run again after the lease.
+func Stop() {
+	mu.Lock()
+	p := current
+	current = nil
+	mu.Unlock()
+
+	if p != nil {
+		close(p.done)
+		p.wg.Wait()
+	}
+}
+
+// CheckStarted returns an error if any model has IAfterTransactAsync hooks but Start hasn't
+// been called. AddRESTRoutes checks it at startup.
+func CheckStarted() error {
+	mu.Lock()
+	started := current != nil
+	mu.Unlock()
+	if started {
+		return nil
+	}
+
+	for typeString := range registry.ModelRegistry {
+		for _, op := range []rest.Op{rest.OpCreate, rest.OpUpdate, rest.OpPatch, rest.OpDelete, rest.OpRestore, rest.OpPurge} {
+			if len(asyncHandlers(typeString, op)) != 0 {
+				return fmt.Errorf("%s: %s", typeString, ErrNotStarted)
+			}
+		}
+	}
+	return nil
+}
+
+// Wake tells the pool there are new entries. The lifecycle functions call it once the
+// transaction is committed.
+func Wake() {
+	mu.Lock()
+	p := current
+	mu.Unlock()
+
+	if p != nil {
+		select {
+		case p.wake <- struct{}{}:
+		default: // already woken
+		}
+	}
+}
+
+// Write inserts an entry for each IAfterTransactAsync hook registered for this op.
+// It's called inside the transaction so the entries are there only if the write is.
+func Write(tx *gorm.DB, ep *hook.EndPoint, ms []mdl.IModel, oldMs []mdl.IModel) error {
+	handlers := asyncHandlers(ep.TypeString, ep.Op)
+	if len(handlers) == 0 {
+		return nil
+	}
+
+	msJSON, err := json.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	oldMsJSON := []byte("null")
+	if oldMs != nil {
+		if oldMsJSON, err = json.Marshal(oldMs); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, handler := range handlers {
+		entry := Entry{
+			ID:            datatype.NewUUID(),
+			TypeString:    ep.TypeString,
+			Handler:       handler.HandlerType.String(),
+			Op:            ep.Op,
+			Cardinality:   ep.Cardinality,
+			URL:           ep.URL,
+			Ms:            registry.RawJSON(msJSON),
+			OldMs:         registry.RawJSON(oldMsJSON),
+			NextAttemptAt: now,
+		}
+		if ep.Who != nil {
+			entry.UserID = ep.Who.GetUserID()
+		}
+
+		if err := tx.New().Create(&entry).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dispatch claims the entries which are due and hands them to the workers
+func (p *pool) dispatch() {
+	defer p.wg.Done()
+
+	for {
+		entries, err := p.claim(p.cfg.Workers)
+		if err != nil {
+			log.Println("outbox: claiming entries:", err)
+		}
+
+		for _, entry := range entries {
+			select {
+			case p.jobs <- entry:
+			case <-p.done:
+				return
+			}
+		}
+
+		if len(entries) == p.cfg.Workers {
+			continue // there may be more
+		}
+
+		select {
+		case <-p.wake:
+		case <-time.After(p.cfg.PollInterval):
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// claim takes up to n due entries, which won't be due again until the lease is over, so
+// other instances skip them
+func (p *pool) claim(n int) ([]*Entry, error) {
+	now := time.Now()
+	entries := make([]*Entry, 0)
+	err := p.db.Raw(`UPDATE better_rest_outbox SET next_attempt_at = ?, attempts = attempts + 1
+		WHERE id IN (SELECT id FROM better_rest_outbox WHERE failed_at IS NULL AND next_attempt_at <= ?
+		ORDER BY next_attempt_at LIMIT ? FOR UPDATE SKIP LOCKED) RETURNING *`,
+		now.Add(p.cfg.Lease), now, n).Scan(&entries).Error
+	return entries, err
+}
+
+func (p *pool) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case entry := <-p.jobs:
+			p.finish(entry, run(entry))
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// finish deletes the entry if it's done, otherwise schedules the retry or gives up
+func (p *pool) finish(entry *Entry, err error) {
+	if err == nil {
+		if err := p.db.Delete(entry).Error; err != nil {
+			log.Println("outbox: deleting entry:", err)
+		}
+		return
+	}
+
+	log.Printf("outbox: %s on %s failed (attempt %d): %s\n", entry.Handler, entry.TypeString, entry.Attempts, err)
+
+	updates := map[string]interface{}{"last_error": err.Error()}
+	if entry.Attempts >= p.cfg.MaxAttempts {
+		updates["failed_at"] = time.Now()
+	} else {
+		backoff := p.cfg.Backoff << uint(entry.Attempts-1)
+		if backoff <= 0 || backoff > p.cfg.MaxBackoff {
+			backoff = p.cfg.MaxBackoff
+		}
+		updates["next_attempt_at"] = time.Now().Add(backoff)
+	}
+
+	if err := p.db.Model(entry).Updates(updates).Error; err != nil {
+		log.Println("outbox: updating entry:", err)
+	}
+}
+
+// run instantiates the hook and calls it
+func run(entry *Entry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			debug.PrintStack()
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	var handler *handlermap.HandlerTypeAndArgs
+	for _, h := range asyncHandlers(entry.TypeString, entry.Op) {
+		if h.HandlerType.String() == entry.Handler {
+			handler = &h
+			break
+		}
+	}
+	if handler == nil {
+		return fmt.Errorf("hook %s is no longer registered", entry.Handler)
+	}
+
+	ms, err := modelsFromJSON(entry.TypeString, entry.Ms)
+	if err != nil {
+		return err
+	}
+	oldMs, err := modelsFromJSON(entry.TypeString, entry.OldMs)
+	if err != nil {
+		return err
+	}
+
+	roles := make([]userrole.UserRole, len(ms))
+	for i := range roles {
+		roles[i] = userrole.UserRoleAdmin // as in the lifecycle functions for writes
+	}
+
+	ep := hook.EndPoint{
+		TypeString:  entry.TypeString,
+		URL:         entry.URL,
+		Op:          entry.Op,
+		Cardinality: entry.Cardinality,
+	}
+	if entry.UserID != nil {
+		ep.Who = &who{userID: entry.UserID}
+	}
+	data := hook.Data{Ms: ms, OldMs: oldMs, Roles: roles, Cargo: &hook.Cargo{}}
+
+	hdlr := reflect.New(handler.HandlerType).Interface().(hook.IHook)
+	if err := inject.Into(hdlr); err != nil {
+		return err
+	}
+	hdlr.Init(&hook.InitData{Roles: roles, Ep: &ep}, handler.Args...)
+	return hdlr.(hook.IAfterTransactAsync).AfterTransactAsync(&data, &ep)
+}
+
+func asyncHandlers(typeString string, op rest.Op) []handlermap.HandlerTypeAndArgs {
+	reg, ok := registry.ModelRegistry[typeString]
+	if !ok || reg.HandlerMap == nil {
+		return nil
+	}
+
+	method := map[rest.Op]string{
+		rest.OpCreate:  "C",
+		rest.OpUpdate:  "U",
+		rest.OpPatch:   "P",
+		rest.OpDelete:  "D",
+		rest.OpRestore: "S",
+		rest.OpPurge:   "X",
+	}[op]
+	if method == "" {
+		return nil
+	}
+	return reg.HandlerMap.GetHandlerTypeAndArgWithFirstHookAt(method, "Y")
+}
+
+func modelsFromJSON(typeString string, j registry.RawJSON) ([]mdl.IModel, error) {
+	raws := make([]json.RawMessage, 0)
+	if j == "" || j == "null" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(j), &raws); err != nil {
+		return nil, err
+	}
+
+	ms := make([]mdl.IModel, len(raws))
+	for i, raw := range raws {
+		ms[i] = registry.NewFromTypeString(typeString)
+		if err := json.Unmarshal(raw, ms[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// who is the user who did the write
+type who struct {
+	userID *datatype.UUID
+}
+
+func (w *who) GetUserID() *datatype.UUID {
+	return w.userID
+}
@@ -0,0 +1,182 @@
+package outbox
+
+import (
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/model/mappertype"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/datatype"
+	"github.com/t2wu/qry/mdl"
+)
+
+type Lock struct {
+	mdl.BaseModel
+
+	Name string `json:"name"`
+}
+
+var asyncCalls int
+var asyncErr error
+
+type LockAsyncHook struct {
+}
+
+func (h *LockAsyncHook) Init(data *hook.InitData, args ...interface{}) {
+}
+
+func (h *LockAsyncHook) AfterTransactAsync(data *hook.Data, ep *hook.EndPoint) error {
+	asyncCalls++
+	return asyncErr
+}
+
+// timeAround matches a time within a second of what's expected
+type timeAround struct {
+	expected time.Time
+}
+
+func (a timeAround) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && t.Sub(a.expected) < time.Second && a.expected.Sub(t) < time.Second
+}
+
+func newPool(t *testing.T, cfg Config) (*pool, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("postgres", sqldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pool{db: db, cfg: cfg}, mock
+}
+
+func registerLock() {
+	delete(registry.ModelRegistry, "locks")
+	opt := registry.RegOptions{BatchMethods: "CRUPD", IdvMethods: "RUPD", Mapper: mappertype.Global}
+	registry.For("locks").ModelWithOption(&Lock{}, opt).Hook(&LockAsyncHook{}, "CU")
+}
+
+func TestClaim_TakesDueEntriesAndLeasesThem(t *testing.T) {
+	p, mock := newPool(t, Config{Lease: time.Minute})
+	id := datatype.NewUUID()
+
+	stmt := `UPDATE better_rest_outbox SET next_attempt_at = $1, attempts = attempts + 1`
+	mock.ExpectQuery(regexp.QuoteMeta(stmt)).
+		WithArgs(timeAround{time.Now().Add(time.Minute)}, timeAround{time.Now()}, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type_string", "handler", "attempts"}).AddRow(id, "locks", "outbox.LockAsyncHook", 1))
+
+	entries, err := p.claim(2)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, id.String(), entries[0].ID.String())
+		assert.Equal(t, 1, entries[0].Attempts)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFinish_WhenSucceeded_DeletesEntry(t *testing.T) {
+	p, mock := newPool(t, Config{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute})
+	entry := &Entry{ID: datatype.NewUUID(), Attempts: 1}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "better_rest_outbox"  WHERE "better_rest_outbox"."id" = $1`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	p.finish(entry, nil)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFinish_WhenFailed_RetriesWithDoubledBackoff(t *testing.T) {
+	p, mock := newPool(t, Config{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: time.Minute})
+	entry := &Entry{ID: datatype.NewUUID(), Attempts: 3} // third attempt failed, 1s, 2s, then 4s
+
+	mock.ExpectBegin()
+	stmt := `UPDATE "better_rest_outbox" SET "last_error" = $1, "next_attempt_at" = $2  WHERE "better_rest_outbox"."id" = $3`
+	mock.ExpectExec(regexp.QuoteMeta(stmt)).
+		WithArgs("unreachable", timeAround{time.Now().Add(4 * time.Second)}, entry.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	p.finish(entry, errors.New("unreachable"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFinish_WhenBackoffTooLong_UsesMaxBackoff(t *testing.T) {
+	p, mock := newPool(t, Config{MaxAttempts: 20, Backoff: time.Second, MaxBackoff: time.Minute})
+	entry := &Entry{ID: datatype.NewUUID(), Attempts: 10} // 512s without the cap
+
+	mock.ExpectBegin()
+	stmt := `UPDATE "better_rest_outbox" SET "last_error" = $1, "next_attempt_at" = $2  WHERE "better_rest_outbox"."id" = $3`
+	mock.ExpectExec(regexp.QuoteMeta(stmt)).
+		WithArgs("unreachable", timeAround{time.Now().Add(time.Minute)}, entry.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	p.finish(entry, errors.New("unreachable"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFinish_WhenMaxAttempts_GivesUp(t *testing.T) {
+	p, mock := newPool(t, Config{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute})
+	entry := &Entry{ID: datatype.NewUUID(), Attempts: 3}
+
+	mock.ExpectBegin()
+	stmt := `UPDATE "better_rest_outbox" SET "failed_at" = $1, "last_error" = $2  WHERE "better_rest_outbox"."id" = $3`
+	mock.ExpectExec(regexp.QuoteMeta(stmt)).
+		WithArgs(timeAround{time.Now()}, "unreachable", entry.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	p.finish(entry, errors.New("unreachable"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRun_CallsTheHookUntilItSucceeds(t *testing.T) {
+	registerLock()
+	defer delete(registry.ModelRegistry, "locks")
+	asyncCalls = 0
+
+	entry := &Entry{
+		TypeString: "locks",
+		Handler:    asyncHandlers("locks", rest.OpCreate)[0].HandlerType.String(), // as Write does
+		Op:         rest.OpCreate,
+		Ms:         registry.RawJSON(`[{"name": "front door"}]`),
+		OldMs:      "null",
+	}
+
+	// The error goes to finish, which schedules the retry, and the retry calls the hook again
+	asyncErr = errors.New("unreachable")
+	assert.Equal(t, asyncErr, run(entry))
+	asyncErr = nil
+	assert.Nil(t, run(entry))
+	assert.Equal(t, 2, asyncCalls)
+
+	// Not registered for delete
+	entry.Op = rest.OpDelete
+	assert.NotNil(t, run(entry))
+}
+
+func TestCheckStarted_WhenAsyncHooksAndNotStarted_GotError(t *testing.T) {
+	registerLock()
+	defer delete(registry.ModelRegistry, "locks")
+
+	err := CheckStarted()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "locks")
+	}
+
+	delete(registry.ModelRegistry, "locks")
+	assert.Nil(t, CheckStarted())
+}
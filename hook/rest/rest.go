@@ -27,6 +27,8 @@ const (
 	OpUpdate
 	OpPatch
 	OpDelete
+	OpRestore // un-delete a soft-deleted record
+	OpPurge   // hard-delete a soft-deleted record
 )
 
 type Cardinality int
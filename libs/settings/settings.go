@@ -3,4 +3,20 @@ package settings
 var (
 	Log           = false
 	TransactDebug = false
+
+	// TextSearchConfig is the Postgres text search configuration used by the q parameter
+	TextSearchConfig = "simple"
+
+	// LegacyLatestN keeps the old latestn query path, including latestn without latestnon.
+	// Going to be removed.
+	LegacyLatestN = false
+
+	// PreloadMaxDepth is how many levels of associations are loaded under the records in ReadMany
+	PreloadMaxDepth = 8
+
+	// NotifyChannel is the Postgres channel committed writes are NOTIFYed on, none if empty
+	NotifyChannel = ""
+
+	// Audit records every write in the better_rest_audit table
+	Audit = false
 )
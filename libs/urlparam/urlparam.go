@@ -1,23 +1,125 @@
 package urlparam
 
-import "strconv"
+import (
+	"strconv"
+	"time"
+)
 
 // Param is the URL parameter
 type Param string
 
 const (
-	ParamOffset        Param = "offset"
-	ParamLimit         Param = "limit"
-	ParamOrder         Param = "order"
-	ParamOrderBy       Param = "orderby"
-	ParamLatestN       Param = "latestn"
-	ParamLatestNOn     Param = "latestnon"
-	ParamCstart        Param = "cstart"
-	ParamCstop         Param = "cstop"
-	ParamHasTotalCount Param = "totalcount"
-	ParamOtherQueries  Param = "better_otherqueries"
+	ParamOffset         Param = "offset"
+	ParamLimit          Param = "limit"
+	ParamOrder          Param = "order"
+	ParamOrderBy        Param = "orderby"
+	ParamLatestN        Param = "latestn"
+	ParamLatestNOn      Param = "latestnon"
+	ParamCstart         Param = "cstart"
+	ParamCstop          Param = "cstop"
+	ParamHasTotalCount  Param = "totalcount"
+	ParamOtherQueries   Param = "better_otherqueries"
+	ParamSearch         Param = "q"
+	ParamTimeRanges     Param = "better_timeranges"
+	ParamLimitApplied   Param = "better_limitapplied"
+	ParamTopN           Param = "topn"
+	ParamTopNOn         Param = "topnon"
+	ParamTopNBy         Param = "topnby"
+	ParamTopNOrder      Param = "topnorder"
+	ParamIncludeDeleted Param = "includeDeleted"
+	ParamPreload        Param = "preload"
+	ParamAsOf           Param = "asOf"
+	ParamOnlyIDs        Param = "better_onlyids"
 )
 
+// GetIncludeDeleted returns whether soft-deleted records are asked for
+func GetIncludeDeleted(options map[Param]interface{}) bool {
+	v, _ := options[ParamIncludeDeleted].(bool)
+	return v
+}
+
+// GetAsOf returns the time the record is read as of, nil if it's the current one
+func GetAsOf(options map[Param]interface{}) *time.Time {
+	if v, ok := options[ParamAsOf].(time.Time); ok {
+		return &v
+	}
+	return nil
+}
+
+// GetOnlyIDs returns the IDs a read is limited to, nil if it's not. It's not from the URL but
+// set for reading the records of an event.
+func GetOnlyIDs(options map[Param]interface{}) []string {
+	v, _ := options[ParamOnlyIDs].([]string)
+	return v
+}
+
+// Preload is which associations are loaded with the records. All is everything (up to the
+// maximum depth), otherwise only Paths (JSON keys joined by dots, such as locations.doors).
+// Neither is none.
+type Preload struct {
+	All   bool
+	Paths []string
+}
+
+// GetPreload returns the preload asked for, nil if not given
+func GetPreload(options map[Param]interface{}) *Preload {
+	if v, ok := options[ParamPreload].(Preload); ok {
+		return &v
+	}
+	return nil
+}
+
+// TopN is the top n records in each group of the On fields, ranked by the By field.
+// latestn=n&latestnon=field is the same as topn=n&topnon=field&topnby=createdAt&topnorder=desc
+type TopN struct {
+	N    int
+	On   []string // JSON keys
+	By   string   // JSON key
+	Desc bool
+
+	ByDefault bool // By is the default createdAt and not asked for, so it isn't checked against sortable fields
+}
+
+// GetTopN returns the top-n-per-group query, nil if there is none
+func GetTopN(options map[Param]interface{}) *TopN {
+	if v, ok := options[ParamTopN].(TopN); ok {
+		return &v
+	}
+	return nil
+}
+
+// GetLimitApplied returns the limit when the server set or lowered it, nil if the client's limit was used
+func GetLimitApplied(options map[Param]interface{}) *int {
+	if v, ok := options[ParamLimitApplied].(int); ok {
+		return &v
+	}
+	return nil
+}
+
+// TimeRange is the range on a time field, e.g. updatedAt.start and updatedAt.stop
+// Either Start or Stop can be nil for an open-ended range
+type TimeRange struct {
+	FieldName string // JSON key
+	Start     *time.Time
+	Stop      *time.Time
+}
+
+// GetTimeRanges returns the time ranges other than cstart and cstop
+func GetTimeRanges(options map[Param]interface{}) []TimeRange {
+	if v, ok := options[ParamTimeRanges].([]TimeRange); ok {
+		return v
+	}
+	return nil
+}
+
+// GetSearch returns the full-text search string, nil if there is none
+func GetSearch(options map[Param]interface{}) *string {
+	if v, ok := options[ParamSearch].(string); ok {
+		return &v
+	}
+	return nil
+}
+
 func GetOptions(options map[Param]interface{}) (offset *int, limit *int, cstart *int, cstop *int, orderby *string, order *string, latestn *int, latestnons []string, count bool) {
 	// If key is in it, even if value is nil, ok will be true
 
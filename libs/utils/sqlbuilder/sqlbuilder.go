@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/jinzhu/gorm"
 	"github.com/stoewer/go-strcase"
+	"github.com/t2wu/betterrest/libs/settings"
 	"github.com/t2wu/betterrest/libs/utils/letters"
+	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/registry"
 	"github.com/t2wu/qry"
 	"github.com/t2wu/qry/datatype"
@@ -170,11 +173,64 @@ func filterHasLateston(filters []FilterCriteria) bool {
 // filters is for latestnons
 func AddLatestNCTEJoin(db *gorm.DB, typeString string, tableName string, latestn int, latestnons []string, filterslatestnons []FilterCriteria) (*gorm.DB, error) {
 	partitionByArr := make([]string, 0)
-	latestnonWhereArr := make([]string, 0)
-	transformedValues := make([]interface{}, 0)
 	m := registry.NewFromTypeString(typeString)
 
-	for _, filter := range filterslatestnons {
+	latestnonWhereArr, transformedValues, err := partitionWhere(m, tableName, filterslatestnons)
+	if err != nil {
+		return db, err
+	}
+
+	// if len(transformedValues) == 0 {
+	// 	return db, fmt.Errorf("latestn cannot be used without querying field value")
+	// }
+
+	// it's possible that there isn't any WHERE clause inside the CTE but we still have to paritition by
+
+	for _, latestnon := range latestnons {
+		actualFieldName, err := mdl.JSONKeysToFieldName(m, latestnon)
+		if err != nil {
+			return db, err
+		}
+		fieldName, err := mdl.FieldNameToColumn(m, actualFieldName)
+		if err != nil {
+			return db, err
+		}
+
+		partitionByArr = append(partitionByArr, fieldName)
+	}
+
+	partitionBy := strings.Join(partitionByArr, ", ")
+
+	var sb strings.Builder
+
+	if len(latestnonWhereArr) > 0 {
+		latestnonWhereStmt := strings.Join(latestnonWhereArr, " AND ")
+		// The latestnon can be here in the WHERE clause
+		sb.WriteString(fmt.Sprintf("INNER JOIN (SELECT id, DENSE_RANK() OVER (PARTITION by %s ORDER BY created_at DESC) FROM %s WHERE %s) AS latestn ",
+			partitionBy, tableName, latestnonWhereStmt)) // WHERE fieldName = fieldValue
+		sb.WriteString(fmt.Sprintf("ON %s AND %s.id = latestn.id AND latestn.dense_rank <= ?", latestnonWhereStmt, tableName))
+	} else { // having partition by (latestnon), but no where clause on latestnon
+		// The latestnon can be here in the WHERE clause
+		sb.WriteString(fmt.Sprintf("INNER JOIN (SELECT id, DENSE_RANK() OVER (PARTITION by %s ORDER BY created_at DESC) FROM %s) AS latestn ",
+			partitionBy, tableName)) // WHERE fieldName = fieldValue
+		sb.WriteString(fmt.Sprintf("ON %s.id = latestn.id AND latestn.dense_rank <= ?", tableName))
+	}
+
+	stmt := sb.String()
+
+	transformedValues = append(transformedValues, transformedValues...)
+	transformedValues = append(transformedValues, latestn)
+
+	db = db.Joins(stmt, transformedValues...)
+	return db, nil
+}
+
+// partitionWhere is the WHERE conditions, and their values, of the filters on the fields a latestn or topn
+// query is partitioned by. Filters on fields not in the model are skipped.
+func partitionWhere(m mdl.IModel, tableName string, filters []FilterCriteria) ([]string, []interface{}, error) {
+	latestnonWhereArr := make([]string, 0)
+	transformedValues := make([]interface{}, 0)
+	for _, filter := range filters {
 		// If there is any equality comparison other than equal
 		// there shouldn't be any IN then
 		hasEquality := false
@@ -200,7 +256,7 @@ func AddLatestNCTEJoin(db *gorm.DB, typeString string, tableName string, latestn
 			continue
 		}
 		if err != nil {
-			return db, err
+			return nil, nil, err
 		}
 
 		filterdFieldValues, anyNull := filterNullValue(transformedFieldValues)
@@ -210,11 +266,11 @@ func AddLatestNCTEJoin(db *gorm.DB, typeString string, tableName string, latestn
 
 		actualFieldName, err := mdl.JSONKeysToFieldName(m, filter.FieldName)
 		if err != nil {
-			return db, err
+			return nil, nil, err
 		}
 		fieldName, err := mdl.FieldNameToColumn(m, actualFieldName)
 		if err != nil {
-			return db, err
+			return nil, nil, err
 		}
 
 		// One field is either >= or =, so we split by equality here
@@ -228,52 +284,40 @@ func AddLatestNCTEJoin(db *gorm.DB, typeString string, tableName string, latestn
 
 	}
 
-	// if len(transformedValues) == 0 {
-	// 	return db, fmt.Errorf("latestn cannot be used without querying field value")
-	// }
-
-	// it's possible that there isn't any WHERE clause inside the CTE but we still have to paritition by
-
-	for _, latestnon := range latestnons {
-		actualFieldName, err := mdl.JSONKeysToFieldName(m, latestnon)
-		if err != nil {
-			return db, err
-		}
-		fieldName, err := mdl.FieldNameToColumn(m, actualFieldName)
-		if err != nil {
-			return db, err
-		}
+	return latestnonWhereArr, transformedValues, nil
+}
 
-		partitionByArr = append(partitionByArr, fieldName)
+// AddTopNJoin keeps the top n rows in each group of partitionBy, ranked by orderBy.
+// Column names are not escaped, they have to be checked against the model first.
+// Filters on the partitionBy fields and excluding soft-deleted rows are also applied inside,
+// so rows which are filtered out don't take up a rank.
+func AddTopNJoin(db *gorm.DB, typeString string, tableName string, n int, partitionBy []string, orderBy string, desc bool,
+	partitionFilters []FilterCriteria, excludeDeleted bool) (*gorm.DB, error) {
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
 	}
 
-	partitionBy := strings.Join(partitionByArr, ", ")
-
-	var sb strings.Builder
-
-	if len(latestnonWhereArr) > 0 {
-		latestnonWhereStmt := strings.Join(latestnonWhereArr, " AND ")
-		// The latestnon can be here in the WHERE clause
-		sb.WriteString(fmt.Sprintf("INNER JOIN (SELECT id, DENSE_RANK() OVER (PARTITION by %s ORDER BY created_at DESC) FROM %s WHERE %s) AS latestn ",
-			partitionBy, tableName, latestnonWhereStmt)) // WHERE fieldName = fieldValue
-		sb.WriteString(fmt.Sprintf("ON %s AND %s.id = latestn.id AND latestn.dense_rank <= ?", latestnonWhereStmt, tableName))
-	} else { // having partition by (latestnon), but no where clause on latestnon
-		// The latestnon can be here in the WHERE clause
-		sb.WriteString(fmt.Sprintf("INNER JOIN (SELECT id, DENSE_RANK() OVER (PARTITION by %s ORDER BY created_at DESC) FROM %s) AS latestn ",
-			partitionBy, tableName)) // WHERE fieldName = fieldValue
-		sb.WriteString(fmt.Sprintf("ON %s.id = latestn.id AND latestn.dense_rank <= ?", tableName))
+	whereArr, values, err := partitionWhere(registry.NewFromTypeString(typeString), tableName, partitionFilters)
+	if err != nil {
+		return db, err
+	}
+	if excludeDeleted {
+		whereArr = append(whereArr, fmt.Sprintf("%s.deleted_at IS NULL", tableName))
 	}
 
-	stmt := sb.String()
-
-	transformedValues = append(transformedValues, transformedValues...)
-	transformedValues = append(transformedValues, latestn)
+	where := ""
+	if len(whereArr) > 0 {
+		where = " WHERE " + strings.Join(whereArr, " AND ")
+	}
 
-	db = db.Joins(stmt, transformedValues...)
-	return db, nil
+	stmt := fmt.Sprintf("INNER JOIN (SELECT id, DENSE_RANK() OVER (PARTITION BY %s ORDER BY %s %s) FROM %s%s) AS topn "+
+		"ON %s.id = topn.id AND topn.dense_rank <= ?", strings.Join(partitionBy, ", "), orderBy, direction, tableName, where, tableName)
+	return db.Joins(stmt, append(values, n)...), nil
 }
 
 // AddLatestJoinWithOneLevelFilter generates latest join with one-level filter
+// Deprecated: only used when settings.LegacyLatestN is set, use AddTopNJoin
 // TODO? Can tablename be part of the "?"
 func AddLatestJoinWithOneLevelFilter(db *gorm.DB, typeString string, tableName string, latestn int, filters []FilterCriteria) (*gorm.DB, error) {
 	hasLatestOn := filterHasLateston(filters)
@@ -634,3 +678,63 @@ func isNil(i interface{}) bool {
 	}()
 	return i == nil || reflect.ValueOf(i).IsNil()
 }
+
+// textSearchConfigRegexp is the names allowed for the text search config, which is formatted into the
+// SQL rather than bound so that an expression index on to_tsvector('<config>', ...) can be used
+var textSearchConfigRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// ValidTextSearchConfig tells if name can be used as the text search config, a (schema qualified) identifier
+func ValidTextSearchConfig(name string) bool {
+	return textSearchConfigRegexp.MatchString(name)
+}
+
+// AddFullTextSearchStmt adds WHERE to_tsvector(...) @@ plainto_tsquery(...) over the fields
+// tagged with betterrest:"searchable"
+func AddFullTextSearchStmt(db *gorm.DB, typeString string, tableName string, search string) (*gorm.DB, error) {
+	vector, err := fullTextVector(typeString, tableName)
+	if err != nil {
+		return db, err
+	}
+
+	return db.Where(fmt.Sprintf("%s @@ plainto_tsquery('%s', ?)", vector, settings.TextSearchConfig), search), nil
+}
+
+// AddFullTextRankOrder orders by how relevant the record is to the search string
+func AddFullTextRankOrder(db *gorm.DB, typeString string, tableName string, search string, asc bool) (*gorm.DB, error) {
+	vector, err := fullTextVector(typeString, tableName)
+	if err != nil {
+		return db, err
+	}
+
+	direction := "DESC"
+	if asc {
+		direction = "ASC"
+	}
+
+	return db.Order(gorm.Expr(fmt.Sprintf("ts_rank(%s, plainto_tsquery('%s', ?)) %s",
+		vector, settings.TextSearchConfig, direction), search)), nil
+}
+
+// fullTextVector concatenates the searchable columns (NULL as empty) into one to_tsvector(...)
+func fullTextVector(typeString string, tableName string) (string, error) {
+	if !ValidTextSearchConfig(settings.TextSearchConfig) {
+		return "", fmt.Errorf("invalid text search config %q", settings.TextSearchConfig)
+	}
+
+	modelObj := registry.NewFromTypeString(typeString)
+	fieldNames := mdlutil.GetFieldNamesFromModelByTagKey(modelObj, "searchable")
+	if len(fieldNames) == 0 {
+		return "", fmt.Errorf("%s has no searchable field", strings.ToLower(typeString))
+	}
+
+	columns := make([]string, len(fieldNames))
+	for i, fieldName := range fieldNames {
+		column, err := mdl.FieldNameToColumn(modelObj, fieldName)
+		if err != nil {
+			return "", err
+		}
+		columns[i] = fmt.Sprintf(`coalesce("%s"."%s"::text, '')`, tableName, column)
+	}
+
+	return fmt.Sprintf("to_tsvector('%s', %s)", settings.TextSearchConfig, strings.Join(columns, ` || ' ' || `)), nil
+}
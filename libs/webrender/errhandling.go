@@ -391,6 +391,40 @@ type ErrDelete struct {
 	ErrResponse
 }
 
+// NewErrDeleteRestricted creates a new ErrDeleteRestricted
+func NewErrDeleteRestricted(err error) render.Renderer {
+	return &ErrDeleteRestricted{
+		ErrResponse{
+			HTTPStatusCode: http.StatusConflict,
+			Code:           104,
+			StatusText:     "resource still has related records",
+			ErrorText:      ErrorToSensibleString(err),
+		},
+	}
+}
+
+// ErrDeleteRestricted the resource can't be deleted because of an onDelete:restrict relation
+type ErrDeleteRestricted struct {
+	ErrResponse
+}
+
+// NewErrUpsertConflict creates a new ErrUpsertConflict
+func NewErrUpsertConflict(err error) render.Renderer {
+	return &ErrUpsertConflict{
+		ErrResponse{
+			HTTPStatusCode: http.StatusConflict,
+			Code:           105,
+			StatusText:     "resource was created by another request, try again",
+			ErrorText:      ErrorToSensibleString(err),
+		},
+	}
+}
+
+// ErrUpsertConflict another request inserted the same ID or natural key while upserting
+type ErrUpsertConflict struct {
+	ErrResponse
+}
+
 /*
  * Internal server error
  */
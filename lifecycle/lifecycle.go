@@ -8,7 +8,13 @@ import (
 	"github.com/t2wu/betterrest/datamapper"
 	"github.com/t2wu/betterrest/datamapper/hfetcher"
 	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/cache"
+	"github.com/t2wu/betterrest/hook/event"
+	"github.com/t2wu/betterrest/hook/notify"
+	"github.com/t2wu/betterrest/hook/outbox"
+	"github.com/t2wu/betterrest/hook/rest"
 	"github.com/t2wu/betterrest/hook/userrole"
+	"github.com/t2wu/betterrest/libs/urlparam"
 	"github.com/t2wu/betterrest/libs/utils/transact"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
@@ -35,7 +41,7 @@ func CreateMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IMod
 		if retVal, retErr = mapper.Create(tx, modelObjs, ep, cargo); retErr != nil {
 			return retErr
 		}
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.CreateMany")
 
 	if retErr != nil {
@@ -59,6 +65,8 @@ func CreateMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IMod
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -77,8 +85,7 @@ func CreateOne(db *gorm.DB, mapper datamapper.IDataMapper, modelObj mdl.IModel,
 		if retVal, retErr = mapper.Create(tx, []mdl.IModel{modelObj}, ep, cargo); retErr != nil {
 			return retErr
 		}
-
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.CreateOne")
 
 	if retErr != nil {
@@ -99,6 +106,8 @@ func CreateOne(db *gorm.DB, mapper datamapper.IDataMapper, modelObj mdl.IModel,
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -142,7 +151,14 @@ func ReadOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID, ep *
 		cargo = &hook.Cargo{}
 	}
 
-	retVal, role, retErr := mapper.ReadOne(db, id, ep, cargo)
+	// It may have been (soft-)deleted since, read it anyway for the permission
+	// (on a copy of the parameters, which are the caller's)
+	epRead := ep
+	if urlparam.GetAsOf(ep.URLParams) != nil {
+		epRead = copyEndPointWithParam(ep, urlparam.ParamIncludeDeleted, true)
+	}
+
+	retVal, role, retErr := mapper.ReadOne(db, id, epRead, cargo)
 	if retErr != nil {
 		if retErr.Renderer == nil {
 			return nil, nil, webrender.NewErrInternalServerError(retErr.Error) // TODO, probably should have a READ error
@@ -155,6 +171,19 @@ func ReadOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID, ep *
 
 	modelObj := retVal.Ms[0]
 
+	// The record as it was then, with the role the user has on it now
+	if asOf := urlparam.GetAsOf(ep.URLParams); asOf != nil {
+		var err error
+		if modelObj, err = datamapper.ReadAsOf(db, ep.TypeString, id, *asOf); err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return nil, nil, webrender.NewErrNotFound(err)
+			} else if err == datamapper.ErrNoHistory || err == datamapper.ErrHistoryNotAvailable {
+				return nil, nil, webrender.NewErrQueryParameter(err)
+			}
+			return nil, nil, webrender.NewErrDBError(err)
+		}
+	}
+
 	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
@@ -164,6 +193,39 @@ func ReadOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID, ep *
 	return &data, retVal.Fetcher, nil
 }
 
+// copyEndPointWithParam copies ep with its URL parameters, and sets the parameter in the copy
+func copyEndPointWithParam(ep *hook.EndPoint, param urlparam.Param, value interface{}) *hook.EndPoint {
+	epCopy := *ep
+	epCopy.URLParams = make(map[urlparam.Param]interface{}, len(ep.URLParams)+1)
+	for k, v := range ep.URLParams {
+		epCopy.URLParams[k] = v
+	}
+	epCopy.URLParams[param] = value
+	return &epCopy
+}
+
+// ReadDistinct counts the distinct values of a field
+func ReadDistinct(db *gorm.DB, mapper datamapper.IDataMapper, field string, ep *hook.EndPoint, cargo *hook.Cargo,
+	logger Logger) ([]datamapper.DistinctValue, render.Renderer) {
+	if logger != nil {
+		logger.Log(nil, "GET", strings.ToLower(ep.TypeString)+"/distinct/"+field, "n")
+	}
+
+	if cargo == nil {
+		cargo = &hook.Cargo{}
+	}
+
+	values, retErr := mapper.ReadDistinct(db, field, ep, cargo)
+	if retErr != nil {
+		if retErr.Renderer == nil {
+			return nil, webrender.NewErrInternalServerError(retErr.Error) // TODO, probably should have a READ error
+		}
+		return nil, retErr.Renderer
+	}
+
+	return values, nil
+}
+
 func UpdateMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IModel,
 	ep *hook.EndPoint, cargo *hook.Cargo, logger Logger) (*hook.Data, *hfetcher.HandlerFetcher, render.Renderer) {
 
@@ -180,8 +242,7 @@ func UpdateMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IMod
 		if retVal, retErr = mapper.Update(tx, modelObjs, ep, cargo); retErr != nil {
 			return retErr
 		}
-
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.UpdateMany")
 	if retErr != nil {
 		if retErr.Renderer == nil {
@@ -197,12 +258,14 @@ func UpdateMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IMod
 		roles[i] = userrole.UserRoleAdmin
 	}
 
-	data := hook.Data{Ms: modelObjs, DB: nil, Roles: roles, Cargo: cargo}
+	data := hook.Data{Ms: modelObjs, DB: nil, Roles: roles, Cargo: cargo, OldMs: retVal.OldMs}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -222,7 +285,7 @@ func UpdateOne(db *gorm.DB, mapper datamapper.IDataMapper, modelObj mdl.IModel,
 		if retVal, retErr = mapper.Update(tx, []mdl.IModel{modelObj}, ep, cargo); retErr != nil {
 			return retErr
 		}
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.UpdateOne")
 	if retErr != nil {
 		if retErr.Renderer == nil {
@@ -234,12 +297,14 @@ func UpdateOne(db *gorm.DB, mapper datamapper.IDataMapper, modelObj mdl.IModel,
 	modelObj = retVal.Ms[0]
 
 	role := userrole.UserRoleAdmin
-	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo}
+	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo, OldMs: retVal.OldMs}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -260,7 +325,7 @@ func PatchMany(db *gorm.DB, mapper datamapper.IDataMapper, jsonIDPatches []mdlut
 		if retVal, retErr = mapper.Patch(tx, jsonIDPatches, ep, cargo); retErr != nil {
 			return retErr
 		}
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.PatchMany")
 
 	if retErr != nil {
@@ -277,12 +342,14 @@ func PatchMany(db *gorm.DB, mapper datamapper.IDataMapper, jsonIDPatches []mdlut
 		roles[i] = userrole.UserRoleAdmin
 	}
 
-	data := hook.Data{Ms: modelObjs, DB: nil, Roles: roles, Cargo: cargo}
+	data := hook.Data{Ms: modelObjs, DB: nil, Roles: roles, Cargo: cargo, OldMs: retVal.OldMs}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -309,8 +376,7 @@ func PatchOne(db *gorm.DB, mapper datamapper.IDataMapper, jsonPatch []byte,
 		if retVal, retErr = mapper.Patch(tx, jsonIDPatches, ep, cargo); retErr != nil {
 			return retErr
 		}
-
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.PatchOne")
 
 	if retErr != nil {
@@ -323,12 +389,14 @@ func PatchOne(db *gorm.DB, mapper datamapper.IDataMapper, jsonPatch []byte,
 	modelObj = retVal.Ms[0]
 
 	role := userrole.UserRoleAdmin
-	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo}
+	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo, OldMs: retVal.OldMs}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -347,7 +415,7 @@ func DeleteMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IMod
 		if retVal, retErr = mapper.DeleteMany(tx, modelObjs, ep, cargo); retErr != nil {
 			return retErr
 		}
-		return nil
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.DeleteMany")
 
 	if retErr != nil {
@@ -364,12 +432,14 @@ func DeleteMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IMod
 		roles[i] = userrole.UserRoleAdmin
 	}
 
-	data := hook.Data{Ms: modelObjs, DB: nil, Roles: roles, Cargo: cargo}
+	data := hook.Data{Ms: modelObjs, DB: nil, Roles: roles, Cargo: cargo, OldMs: retVal.OldMs}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
 
@@ -385,7 +455,7 @@ func DeleteOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID,
 		if retVal, retErr = mapper.DeleteOne(tx, id, ep, cargo); retErr != nil {
 			return retErr
 		}
-		return
+		return inTransaction(tx, ep, retVal)
 	}, "lifecycle.DeleteOne")
 	if retErr != nil {
 		if retErr.Renderer == nil {
@@ -397,11 +467,237 @@ func DeleteOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID,
 	modelObj := retVal.Ms[0]
 
 	role := userrole.UserRoleAdmin
-	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo}
+	data := hook.Data{Ms: []mdl.IModel{modelObj}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo, OldMs: retVal.OldMs}
+
+	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
+		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
+	}
+
+	afterCommit(ep, retVal)
+
+	return &data, retVal.Fetcher, nil
+}
+
+// RestoreOne un-deletes a soft-deleted record
+func RestoreOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID,
+	ep *hook.EndPoint, cargo *hook.Cargo, logger Logger) (*hook.Data, *hfetcher.HandlerFetcher, render.Renderer) {
+	if cargo == nil {
+		cargo = &hook.Cargo{}
+	}
+	var retVal *datamapper.MapperRet
+	retErr := transact.TransactCustomError(db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		if logger != nil {
+			logger.Log(tx, "POST", strings.ToLower(ep.TypeString)+"/restore", "1")
+		}
+
+		if retVal, retErr = mapper.RestoreOne(tx, id, ep, cargo); retErr != nil {
+			return retErr
+		}
+		return inTransaction(tx, ep, retVal)
+	}, "lifecycle.RestoreOne")
+	if retErr != nil {
+		if retErr.Renderer == nil {
+			return nil, nil, webrender.NewErrUpdate(retErr.Error)
+		}
+		return nil, nil, retErr.Renderer
+	}
+
+	data := hook.Data{Ms: []mdl.IModel{retVal.Ms[0]}, DB: nil, Roles: retVal.Roles, Cargo: cargo, OldMs: retVal.OldMs}
+
+	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
+		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
+	}
+
+	afterCommit(ep, retVal)
+
+	return &data, retVal.Fetcher, nil
+}
+
+// PurgeOne hard-deletes a soft-deleted record
+func PurgeOne(db *gorm.DB, mapper datamapper.IDataMapper, id *datatype.UUID,
+	ep *hook.EndPoint, cargo *hook.Cargo, logger Logger) (*hook.Data, *hfetcher.HandlerFetcher, render.Renderer) {
+	if cargo == nil {
+		cargo = &hook.Cargo{}
+	}
+	var retVal *datamapper.MapperRet
+	retErr := transact.TransactCustomError(db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		if logger != nil {
+			logger.Log(tx, "DELETE", strings.ToLower(ep.TypeString)+"/purge", "1")
+		}
+
+		if retVal, retErr = mapper.PurgeOne(tx, id, ep, cargo); retErr != nil {
+			return retErr
+		}
+		return inTransaction(tx, ep, retVal)
+	}, "lifecycle.PurgeOne")
+	if retErr != nil {
+		if retErr.Renderer == nil {
+			return nil, nil, webrender.NewErrDelete(retErr.Error)
+		}
+		return nil, nil, retErr.Renderer
+	}
+
+	role := userrole.UserRoleAdmin
+	data := hook.Data{Ms: []mdl.IModel{retVal.Ms[0]}, DB: nil, Roles: []userrole.UserRole{role}, Cargo: cargo, OldMs: retVal.OldMs}
 
 	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
 		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
 	}
 
+	afterCommit(ep, retVal)
+
 	return &data, retVal.Fetcher, nil
 }
+
+// UpsertMany creates the records which don't exist yet and updates the others (Registrar.Upsert).
+// The created ones go through create permission and create hooks, the rest through update. The
+// fetchers are those of create and update (whichever were used), for rendering.
+func UpsertMany(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IModel,
+	ep *hook.EndPoint, cargo *hook.Cargo, logger Logger) (*hook.Data, []*hfetcher.HandlerFetcher, render.Renderer) {
+	return upsert(db, mapper, modelObjs, ep, cargo, logger, "n")
+}
+
+// UpsertOne creates the record if it doesn't exist yet, or updates it otherwise (Registrar.Upsert)
+func UpsertOne(db *gorm.DB, mapper datamapper.IDataMapper, modelObj mdl.IModel,
+	ep *hook.EndPoint, cargo *hook.Cargo, logger Logger) (*hook.Data, []*hfetcher.HandlerFetcher, render.Renderer) {
+	return upsert(db, mapper, []mdl.IModel{modelObj}, ep, cargo, logger, "1")
+}
+
+// upsert is called with ep.Op being update. A soft-deleted record found is restored the way
+// POST /restore does (with its permission and hooks) before it's updated.
+func upsert(db *gorm.DB, mapper datamapper.IDataMapper, modelObjs []mdl.IModel,
+	ep *hook.EndPoint, cargo *hook.Cargo, logger Logger, cardinality string) (*hook.Data, []*hfetcher.HandlerFetcher, render.Renderer) {
+	if cargo == nil {
+		cargo = &hook.Cargo{}
+	}
+
+	epCreate, epRestore := *ep, *ep
+	epCreate.Op, epRestore.Op = rest.OpCreate, rest.OpRestore
+
+	var exists []bool
+	var createRet, updateRet *datamapper.MapperRet
+	restoreRets := make([]*datamapper.MapperRet, 0)
+	retErr := transact.TransactCustomError(db, func(tx *gorm.DB) (retErr *webrender.RetError) {
+		if logger != nil {
+			logger.Log(tx, "PUT", strings.ToLower(ep.TypeString), cardinality)
+		}
+
+		var deleted []bool
+		if exists, deleted, retErr = mapper.ModelsExist(tx, modelObjs, ep); retErr != nil {
+			return retErr
+		}
+
+		toCreate, toUpdate := make([]mdl.IModel, 0), make([]mdl.IModel, 0)
+		for i, modelObj := range modelObjs {
+			if deleted[i] {
+				restoreRet, retErr := mapper.RestoreOne(tx, modelObj.GetID(), &epRestore, cargo)
+				if retErr != nil {
+					return retErr
+				}
+				if retErr = inTransaction(tx, &epRestore, restoreRet); retErr != nil {
+					return retErr
+				}
+				restoreRets = append(restoreRets, restoreRet)
+			}
+
+			if exists[i] {
+				toUpdate = append(toUpdate, modelObj)
+			} else {
+				toCreate = append(toCreate, modelObj)
+			}
+		}
+
+		if len(toCreate) != 0 {
+			txInsert, err := datamapper.UpsertInsertDB(tx, ep.TypeString)
+			if err != nil {
+				return &webrender.RetError{Error: err}
+			}
+			if createRet, retErr = mapper.Create(txInsert, toCreate, &epCreate, cargo); retErr != nil {
+				return retErr
+			}
+			if retErr = inTransaction(tx, &epCreate, createRet); retErr != nil {
+				return retErr
+			}
+		}
+		if len(toUpdate) != 0 {
+			if updateRet, retErr = mapper.Update(tx, toUpdate, ep, cargo); retErr != nil {
+				return retErr
+			}
+			if retErr = inTransaction(tx, ep, updateRet); retErr != nil {
+				return retErr
+			}
+		}
+		return nil
+	}, "lifecycle.Upsert")
+	if retErr != nil {
+		if retErr.Renderer == nil {
+			return nil, nil, webrender.NewErrUpdate(retErr.Error)
+		}
+		return nil, nil, retErr.Renderer
+	}
+
+	// Back to the order in the request
+	ms := make([]mdl.IModel, len(modelObjs))
+	roles := make([]userrole.UserRole, len(modelObjs))
+	c, u := 0, 0
+	for i := range modelObjs {
+		if exists[i] {
+			ms[i] = updateRet.Ms[u]
+			u++
+		} else {
+			ms[i] = createRet.Ms[c]
+			c++
+		}
+		roles[i] = userrole.UserRoleAdmin
+	}
+
+	fetchers := make([]*hfetcher.HandlerFetcher, 0)
+	if createRet != nil {
+		afterTransact(createRet, &epCreate, cargo)
+		afterCommit(&epCreate, createRet)
+		fetchers = append(fetchers, createRet.Fetcher)
+	}
+	for _, restoreRet := range restoreRets {
+		afterTransact(restoreRet, &epRestore, cargo)
+		afterCommit(&epRestore, restoreRet)
+	}
+	if updateRet != nil {
+		afterTransact(updateRet, ep, cargo)
+		afterCommit(ep, updateRet)
+		fetchers = append(fetchers, updateRet.Fetcher)
+	}
+
+	data := hook.Data{Ms: ms, DB: nil, Roles: roles, Cargo: cargo}
+	return &data, fetchers, nil
+}
+
+func afterTransact(retVal *datamapper.MapperRet, ep *hook.EndPoint, cargo *hook.Cargo) {
+	roles := make([]userrole.UserRole, len(retVal.Ms))
+	for i := 0; i < len(roles); i++ {
+		roles[i] = userrole.UserRoleAdmin
+	}
+
+	data := hook.Data{Ms: retVal.Ms, DB: nil, Roles: roles, Cargo: cargo, OldMs: retVal.OldMs}
+	for _, hdlr := range retVal.Fetcher.FetchHandlersForOpAndHook(ep.Op, "T") {
+		hdlr.(hook.IAfterTransact).AfterTransact(&data, ep)
+	}
+}
+
+// inTransaction is what's written in the transaction of every write after the mapper: the
+// notification to other instances and the IAfterTransactAsync hooks in the outbox
+func inTransaction(tx *gorm.DB, ep *hook.EndPoint, retVal *datamapper.MapperRet) *webrender.RetError {
+	if err := notify.Publish(tx, ep.TypeString, ep.Op, retVal.Ms); err != nil {
+		return &webrender.RetError{Error: err}
+	}
+	if err := outbox.Write(tx, ep, retVal.Ms, retVal.OldMs); err != nil {
+		return &webrender.RetError{Error: err}
+	}
+	return nil
+}
+
+// afterCommit is done after every write is committed, following the AfterTransact hooks
+func afterCommit(ep *hook.EndPoint, retVal *datamapper.MapperRet) {
+	cache.Invalidate(ep.TypeString) // cached reads of this type are stale now
+	outbox.Wake()                   // for the IAfterTransactAsync hooks written in the transaction
+	event.Publish(ep, retVal.Ms, retVal.OldMs)
+}
@@ -205,6 +205,24 @@ func GetFieldNameFromModelByTagKey(modelObj interface{}, valueKey string) *strin
 	return nil
 }
 
+// GetFieldNamesFromModelByTagKey get's the names of all the fields tagged with valueKey
+func GetFieldNamesFromModelByTagKey(modelObj interface{}, valueKey string) []string {
+	names := make([]string, 0)
+	v := reflect.Indirect(reflect.ValueOf(modelObj))
+	for i := 0; i < v.NumField(); i++ {
+		if tagVal, ok := v.Type().Field(i).Tag.Lookup("betterrest"); ok {
+			pairs := strings.Split(tagVal, ";")
+			for _, pair := range pairs {
+				if pair == valueKey {
+					names = append(names, v.Type().Field(i).Name)
+					break
+				}
+			}
+		}
+	}
+	return names
+}
+
 // GetFieldValueFromModelByTagKeyBetterRestAndValueKey fetches value of the variable tagged in tag
 func GetFieldValueFromModelByTagKeyBetterRestAndValueKey(modelObj mdl.IModel, valueKey string) interface{} {
 	v := reflect.Indirect(reflect.ValueOf(modelObj))
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/t2wu/betterrest/db"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/qry/datatype"
+)
+
+// RawJSON is JSON stored in a jsonb column and rendered as is
+type RawJSON string
+
+// MarshalJSON renders the JSON without quoting it
+func (j RawJSON) MarshalJSON() ([]byte, error) {
+	if j == "" {
+		return []byte("null"), nil
+	}
+	return []byte(j), nil
+}
+
+// BetterRESTAudit is one audit entry, a write to one record (settings.Audit)
+type BetterRESTAudit struct {
+	ID        *datatype.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	CreatedAt time.Time      `sql:"index" json:"createdAt"`
+
+	UserID     *datatype.UUID `gorm:"type:uuid;index" json:"userId"`
+	TypeString string         `gorm:"index:idx_better_rest_audit_model" json:"typeString"`
+	ModelID    *datatype.UUID `gorm:"type:uuid;index:idx_better_rest_audit_model" json:"modelId"`
+	Op         rest.Op        `json:"op"`
+	URL        string         `json:"url"`
+
+	// Before and After are the record in JSON, Before is null for create and After for delete
+	Before *RawJSON `gorm:"type:jsonb" json:"before"`
+	After  *RawJSON `gorm:"type:jsonb" json:"after"`
+
+	// Diff has the top-level fields which changed, {"field": {"old": ..., "new": ...}}
+	Diff RawJSON `gorm:"type:jsonb" json:"diff"`
+}
+
+// TableName is better_rest_audit
+func (BetterRESTAudit) TableName() string {
+	return "better_rest_audit"
+}
+
+// CreateBetterRESTAuditTable creates the audit table if it's not there
+func CreateBetterRESTAuditTable() {
+	db.Shared().AutoMigrate(&BetterRESTAudit{})
+}
@@ -1,7 +1,9 @@
 package handlermap
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/t2wu/betterrest/hook"
@@ -11,11 +13,14 @@ import (
 type HandlerTypeAndArgs struct {
 	HandlerType reflect.Type
 	Args        []interface{}
+	Global      bool // registered for all models, see RegisterGlobalHandler
 }
 
 func NewHandlerMap() *HandlerMap {
 	return &HandlerMap{
 		controllerMap: make(map[string]map[string][]HandlerTypeAndArgs),
+		orderings:     make(map[reflect.Type]*hook.Ordering),
+		ranks:         make(map[reflect.Type]int),
 	}
 }
 
@@ -23,16 +28,22 @@ type HandlerMap struct {
 	// HTTP method (CRUPD) -> Hook (JBATR) -> Controllers
 	// Method: CRUPD
 	// Hook: JBATR (J for before json patch is applied, only valid for patch)
-	// R is Render
+	// R is Render, Q is IBeforeQuery (only valid for read)
 	controllerMap                              map[string]map[string][]HandlerTypeAndArgs
 	hasAtLeastOneControllerWithHooksRegistered bool
 	hasAtLeastOneControllerAttemptRegistered   bool
+
+	// For the calling order of handlers at the same hook
+	types     []reflect.Type // each handler type once, in the order registered
+	orderings map[reflect.Type]*hook.Ordering
+	ranks     map[reflect.Type]int // lower is called first
+	orderErr  error                // cycle in RunBefore/RunAfter
 }
 
 // RegisterHandler
-// restMethod is CRUPD in any combination
-// hookTypes is JBAT in any combination (where J is before JSON apply)
-// The first available hook type of R is B
+// restMethod is CRUPD in any combination, plus S for restore and X for purge
+// hookTypes is JBAT in any combination (where J is before JSON apply), Y is IAfterTransactAsync
+// The first available hook type of R is C (cache), then Q (IBeforeQuery)
 // The first available hook type for P is J
 // BAT
 // CRUPD, ABT --> Initalized with CB
@@ -40,12 +51,85 @@ type HandlerMap struct {
 // UP, A --> Initialized at Update after or patch after
 // D, A --> Initialied at delete after
 func (h *HandlerMap) RegisterHandler(hdlr hook.IHook, restMethods string, args ...interface{}) {
-	// func (h *HandlerMap) RegisterHandler(hdlr hook.IHook, restMethods string, args ...interface{}) {
+	h.registerHandler(hdlr, restMethods, false, args...)
+}
+
+// RegisterGlobalHandler is RegisterHandler for a handler registered for all models, which
+// can be removed with RemoveGlobalHandlers
+func (h *HandlerMap) RegisterGlobalHandler(hdlr hook.IHook, restMethods string, args ...interface{}) {
+	h.registerHandler(hdlr, restMethods, true, args...)
+}
+
+// RemoveGlobalHandlers removes the global handlers of these types, or all of them if no type is given.
+// Handlers of the same types registered with RegisterHandler stay.
+func (h *HandlerMap) RemoveGlobalHandlers(handlerTypes ...reflect.Type) {
+	remove := func(handlerTypeAndArgs HandlerTypeAndArgs) bool {
+		if !handlerTypeAndArgs.Global {
+			return false
+		}
+		for _, typ := range handlerTypes {
+			if typ == handlerTypeAndArgs.HandlerType {
+				return true
+			}
+		}
+		return len(handlerTypes) == 0
+	}
+
+	stillRegistered := make(map[reflect.Type]bool)
+	for method, hookMap := range h.controllerMap {
+		for firstHook, arr := range hookMap {
+			kept := make([]HandlerTypeAndArgs, 0, len(arr))
+			for _, handlerTypeAndArgs := range arr {
+				if !remove(handlerTypeAndArgs) {
+					kept = append(kept, handlerTypeAndArgs)
+					stillRegistered[handlerTypeAndArgs.HandlerType] = true
+				}
+			}
+			h.controllerMap[method][firstHook] = kept
+		}
+	}
+
+	types := make([]reflect.Type, 0, len(h.types))
+	for _, typ := range h.types {
+		if stillRegistered[typ] {
+			types = append(types, typ)
+		} else {
+			delete(h.orderings, typ)
+		}
+	}
+	h.types = types
+	h.sortTypes()
+}
+
+func (h *HandlerMap) registerHandler(hdlr hook.IHook, restMethods string, global bool, args ...interface{}) {
 	h.hasAtLeastOneControllerAttemptRegistered = true
 	typ := reflect.TypeOf(hdlr).Elem()
+
+	// Ordering options are for us, not the handler
+	initArgs := make([]interface{}, 0, len(args))
+	ordering, ok := h.orderings[typ]
+	if !ok {
+		ordering = &hook.Ordering{}
+		h.orderings[typ] = ordering
+		h.types = append(h.types, typ)
+	}
+	for _, arg := range args {
+		if o, ok := arg.(hook.Ordering); ok {
+			if o.Priority != 0 {
+				ordering.Priority = o.Priority
+			}
+			ordering.Before = append(ordering.Before, o.Before...)
+			ordering.After = append(ordering.After, o.After...)
+		} else {
+			initArgs = append(initArgs, arg)
+		}
+	}
+	h.sortTypes()
+
 	handlerTypeAndArg := HandlerTypeAndArgs{
 		HandlerType: typ,
-		Args:        args,
+		Args:        initArgs,
+		Global:      global,
 	}
 	if strings.Contains(restMethods, "C") {
 		if firstHook := h.getFirstHookType(rest.OpCreate, handlerTypeAndArg.HandlerType); firstHook != "" {
@@ -72,6 +156,25 @@ func (h *HandlerMap) RegisterHandler(hdlr hook.IHook, restMethods string, args .
 			h.putControllerWithMethodAndHookInMap("D", firstHook, handlerTypeAndArg)
 		}
 	}
+	if strings.Contains(restMethods, "S") { // reStore
+		if firstHook := h.getFirstHookType(rest.OpRestore, handlerTypeAndArg.HandlerType); firstHook != "" {
+			h.putControllerWithMethodAndHookInMap("S", firstHook, handlerTypeAndArg)
+		}
+	}
+	if strings.Contains(restMethods, "X") { // purge (eXpunge)
+		if firstHook := h.getFirstHookType(rest.OpPurge, handlerTypeAndArg.HandlerType); firstHook != "" {
+			h.putControllerWithMethodAndHookInMap("X", firstHook, handlerTypeAndArg)
+		}
+	}
+
+	// Y is for IAfterTransactAsync, which is run by hook/outbox on its own instance
+	if _, ok := hdlr.(hook.IAfterTransactAsync); ok {
+		for _, method := range "CUPDSX" {
+			if strings.ContainsRune(restMethods, method) {
+				h.putControllerWithMethodAndHookInMap(string(method), "Y", handlerTypeAndArg)
+			}
+		}
+	}
 }
 
 // GetHandlerTypeAndArgWithFirstHookAt obtains relevant handler and args if in this method and in this hook
@@ -83,6 +186,24 @@ func (h *HandlerMap) GetHandlerTypeAndArgWithFirstHookAt(method string, firstHoo
 	return append(arr, h.controllerMap[method][firstHook]...)
 }
 
+// Rank is where handlers of this type are in the calling order, lower is called first
+func (h *HandlerMap) Rank(handlerType reflect.Type) int {
+	if rank, ok := h.ranks[handlerType]; ok {
+		return rank
+	}
+	return len(h.ranks) // not registered here, last
+}
+
+// Types are the handler types registered, each once
+func (h *HandlerMap) Types() []reflect.Type {
+	return append([]reflect.Type{}, h.types...)
+}
+
+// CheckOrder returns an error if RunBefore and RunAfter of the handlers form a cycle
+func (h *HandlerMap) CheckOrder() error {
+	return h.orderErr
+}
+
 // func (h *HandlerMap) HasRegisteredAnyHandlerWithHooks() bool {
 // 	return h.hasAtLeastOneControllerWithHooksRegistered
 // }
@@ -110,6 +231,8 @@ func (h *HandlerMap) getFirstHookType(op rest.Op, handlerType reflect.Type) stri
 	} else if op == rest.OpRead {
 		if _, ok := hdlr.(hook.ICache); ok {
 			return "C"
+		} else if _, ok := hdlr.(hook.IBeforeQuery); ok {
+			return "Q"
 		} else if _, ok := hdlr.(hook.IAfter); ok {
 			return "A"
 		} else if _, ok := hdlr.(hook.IAfterTransact); ok {
@@ -143,3 +266,99 @@ func (h *HandlerMap) putControllerWithMethodAndHookInMap(method, firstHook strin
 	h.controllerMap[method][firstHook] = append(h.controllerMap[method][firstHook], handlerTypeAndArgs)
 	h.hasAtLeastOneControllerWithHooksRegistered = true
 }
+
+// sortTypes ranks the handler types, RunBefore and RunAfter first, then the priority, then the
+// order registered. If there is a cycle it's only the order registered.
+func (h *HandlerMap) sortTypes() {
+	index := make(map[reflect.Type]int, len(h.types))
+	for i, typ := range h.types {
+		index[typ] = i
+	}
+
+	next := make(map[reflect.Type][]reflect.Type) // the types which have to wait for it
+	indegree := make(map[reflect.Type]int)
+	addEdge := func(first, then reflect.Type) {
+		_, ok1 := index[first]
+		_, ok2 := index[then]
+		if ok1 && ok2 && first != then { // a type not registered here doesn't matter
+			next[first] = append(next[first], then)
+			indegree[then]++
+		}
+	}
+	for _, typ := range h.types {
+		for _, other := range h.orderings[typ].Before {
+			addEdge(typ, other)
+		}
+		for _, other := range h.orderings[typ].After {
+			addEdge(other, typ)
+		}
+	}
+
+	// A hook which has to run before one of a higher priority takes up that priority
+	priorities := make(map[reflect.Type]int)
+	var priorityOf func(typ reflect.Type, visiting map[reflect.Type]bool) int
+	priorityOf = func(typ reflect.Type, visiting map[reflect.Type]bool) int {
+		if p, ok := priorities[typ]; ok {
+			return p
+		}
+		p := h.orderings[typ].Priority
+		visiting[typ] = true
+		for _, other := range next[typ] {
+			if !visiting[other] { // in a cycle otherwise
+				if p2 := priorityOf(other, visiting); p2 > p {
+					p = p2
+				}
+			}
+		}
+		delete(visiting, typ)
+		priorities[typ] = p
+		return p
+	}
+	for _, typ := range h.types {
+		priorityOf(typ, make(map[reflect.Type]bool))
+	}
+
+	ready := make([]reflect.Type, 0)
+	for _, typ := range h.types {
+		if indegree[typ] == 0 {
+			ready = append(ready, typ)
+		}
+	}
+
+	ranks := make(map[reflect.Type]int, len(h.types))
+	for len(ready) > 0 {
+		sort.SliceStable(ready, func(i, j int) bool {
+			pi, pj := priorities[ready[i]], priorities[ready[j]]
+			if pi != pj {
+				return pi > pj
+			}
+			return index[ready[i]] < index[ready[j]]
+		})
+
+		typ := ready[0]
+		ready = ready[1:]
+		ranks[typ] = len(ranks)
+		for _, other := range next[typ] {
+			if indegree[other]--; indegree[other] == 0 {
+				ready = append(ready, other)
+			}
+		}
+	}
+
+	h.orderErr = nil
+	if len(ranks) < len(h.types) {
+		names := make([]string, 0)
+		for _, typ := range h.types {
+			if _, ok := ranks[typ]; !ok {
+				names = append(names, typ.String())
+			}
+		}
+		h.orderErr = fmt.Errorf("hooks %s run before or after each other in a cycle", strings.Join(names, ", "))
+
+		for i, typ := range h.types {
+			ranks[typ] = i
+		}
+	}
+
+	h.ranks = ranks
+}
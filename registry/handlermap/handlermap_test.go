@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
 	"github.com/t2wu/betterrest/hook"
 	"github.com/t2wu/betterrest/libs/webrender"
@@ -474,3 +475,100 @@ func Test_ControllerMap_AddMultipleControllerWithDifferentFirstHook(t *testing.T
 // 	c.RegisterHandler(&Handler1FirstHookAfter{}, "C")
 // 	assert.True(t, c.HasRegisteredAnyHandlerWithHooks())
 // }
+
+func Test_ControllerMap_RankWithoutOrdering_IsRegistrationOrder(t *testing.T) {
+	c := NewHandlerMap()
+	c.RegisterHandler(&Handler1FirstHookAfter{}, "C")
+	c.RegisterHandler(&Handler1FirstHookBefore{}, "C")
+	assert.Less(t, c.Rank(reflect.TypeOf(Handler1FirstHookAfter{})), c.Rank(reflect.TypeOf(Handler1FirstHookBefore{})))
+	assert.Nil(t, c.CheckOrder())
+}
+
+func Test_ControllerMap_RankWithPriorityAndRunBefore(t *testing.T) {
+	c := NewHandlerMap()
+	c.RegisterHandler(&Handler1FirstHookAfter{}, "C")
+	c.RegisterHandler(&Handler1FirstHookBefore{}, "C", hook.Priority(10), "injected")
+	c.RegisterHandler(&Handler2FirstHookBefore{}, "C", hook.RunBefore(&Handler1FirstHookBefore{}))
+
+	r1 := c.Rank(reflect.TypeOf(Handler1FirstHookAfter{}))
+	r2 := c.Rank(reflect.TypeOf(Handler1FirstHookBefore{}))
+	r3 := c.Rank(reflect.TypeOf(Handler2FirstHookBefore{}))
+	assert.Less(t, r3, r2)
+	assert.Less(t, r2, r1)
+	assert.Nil(t, c.CheckOrder())
+
+	// The ordering isn't passed to Init
+	arr := c.GetHandlerTypeAndArgWithFirstHookAt("C", "B")
+	if assert.Len(t, arr, 2) {
+		assert.Equal(t, []interface{}{"injected"}, arr[0].Args)
+	}
+}
+
+func Test_ControllerMap_CycleInRunBeforeAndAfter_ShouldError(t *testing.T) {
+	c := NewHandlerMap()
+	c.RegisterHandler(&Handler1FirstHookBefore{}, "C", hook.RunBefore(&Handler2FirstHookBefore{}))
+	c.RegisterHandler(&Handler2FirstHookBefore{}, "C", hook.RunBefore(&Handler1FirstHookBefore{}))
+	assert.Error(t, c.CheckOrder())
+}
+
+func Test_ControllerMap_RemoveGlobalHandlers_KeepsTheSameTypeRegisteredForTheModel(t *testing.T) {
+	c := NewHandlerMap()
+	c.RegisterGlobalHandler(&Handler1FirstHookBefore{}, "C")
+	c.RegisterGlobalHandler(&Handler2FirstHookBefore{}, "C")
+	c.RegisterHandler(&Handler1FirstHookBefore{}, "C", "own")
+
+	c.RemoveGlobalHandlers(reflect.TypeOf(Handler1FirstHookBefore{}))
+	arr := c.GetHandlerTypeAndArgWithFirstHookAt("C", "B")
+	if assert.Len(t, arr, 2) {
+		assert.Equal(t, reflect.TypeOf(Handler2FirstHookBefore{}), arr[0].HandlerType)
+		assert.Equal(t, []interface{}{"own"}, arr[1].Args)
+	}
+
+	c.RemoveGlobalHandlers()
+	arr = c.GetHandlerTypeAndArgWithFirstHookAt("C", "B")
+	if assert.Len(t, arr, 1) {
+		assert.False(t, arr[0].Global)
+	}
+}
+
+type HandlerAsync struct {
+}
+
+func (c *HandlerAsync) Init(data *hook.InitData, args ...interface{}) {
+}
+func (c *HandlerAsync) AfterTransactAsync(data *hook.Data, info *hook.EndPoint) error {
+	return nil
+}
+
+func Test_ControllerMap_AddAsyncHandler_ShouldReturnOnlyWhenAsyncQueriedExceptRead(t *testing.T) {
+	c := NewHandlerMap()
+	c.RegisterHandler(&HandlerAsync{}, "CRUPD")
+	for _, method := range []string{"C", "U", "P", "D"} {
+		assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt(method, "Y"), 1)
+		for _, hookType := range []string{"J", "B", "A", "T", "R"} {
+			assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt(method, hookType), 0)
+		}
+	}
+	assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt("R", "Y"), 0)
+}
+
+type HandlerBeforeQueryAndAfter struct {
+}
+
+func (c *HandlerBeforeQueryAndAfter) Init(data *hook.InitData, args ...interface{}) {
+}
+func (c *HandlerBeforeQueryAndAfter) BeforeQuery(db *gorm.DB, info *hook.EndPoint) (*gorm.DB, *webrender.RetError) {
+	return db, nil
+}
+func (c *HandlerBeforeQueryAndAfter) After(data *hook.Data, info *hook.EndPoint) *webrender.RetError {
+	return nil
+}
+
+func Test_ControllerMap_AddBeforeQueryHandler_FirstHookIsBeforeQueryOnlyForRead(t *testing.T) {
+	c := NewHandlerMap()
+	c.RegisterHandler(&HandlerBeforeQueryAndAfter{}, "CR")
+	assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt("R", "Q"), 1)
+	assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt("R", "A"), 0)
+	assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt("C", "Q"), 0)
+	assert.Len(t, c.GetHandlerTypeAndArgWithFirstHookAt("C", "A"), 1)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/userrole"
 	"github.com/t2wu/betterrest/libs/utils/jsontrans"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/mdlutil"
@@ -26,12 +27,41 @@ func RegRoleSorter(sorter hook.IRoleSorter) {
 	RoleSorter = sorter
 }
 
+// globalHook is a handler registered for all models with RegGlobalHook
+type globalHook struct {
+	hdlr   hook.IHook
+	method string
+	args   []interface{}
+}
+
+var globalHooks []globalHook
+
+// RegGlobalHook registers the handler, like Registrar's Hook(), for every model including
+// those registered later. A model can opt out with Registrar's NoGlobalHook().
+func RegGlobalHook(hdlr hook.IHook, method string, args ...interface{}) {
+	globalHooks = append(globalHooks, globalHook{hdlr: hdlr, method: method, args: args})
+	for _, reg := range ModelRegistry {
+		if reg.HandlerMap != nil && !reg.optsOutOfGlobalHook(hdlr) {
+			reg.HandlerMap.RegisterGlobalHandler(hdlr, method, args...)
+		}
+	}
+}
+
+// newHandlerMap is a handler map with the global hooks
+func newHandlerMap() *handlermap.HandlerMap {
+	handlerMap := handlermap.NewHandlerMap()
+	for _, g := range globalHooks {
+		handlerMap.RegisterGlobalHandler(g.hdlr, g.method, g.args...)
+	}
+	return handlerMap
+}
+
 // For set the current registering typeString
 func For(typeString string) *Registrar {
 	r := NewRegistrar(typeString)
 	if _, ok := ModelRegistry[typeString]; !ok {
 		ModelRegistry[typeString] = &Reg{
-			HandlerMap: handlermap.NewHandlerMap(),
+			HandlerMap: newHandlerMap(),
 		}
 	}
 	return r
@@ -125,20 +155,133 @@ func (r *Registrar) ModelWithOption(modelObj mdl.IModel, options RegOptions) *Re
 	checked := make(map[string]bool)
 	checkFieldsThatAreStructsForBetterTags(modelObj, checked)
 
+	// Only the tagged fields can be queried on if any is tagged
+	if keys := jsonKeysOfFieldsTaggedWith(modelObj, "filterable"); len(keys) != 0 {
+		reg.FilterableFields = addKeys(reg.FilterableFields, keys)
+	}
+	if keys := jsonKeysOfFieldsTaggedWith(modelObj, "sortable"); len(keys) != 0 {
+		reg.SortableFields = addKeys(reg.SortableFields, keys)
+	}
+
+	return r
+}
+
+// Filterable lists the fields (JSON keys) which can be filtered on by URL query,
+// others get a 400. Nested fields are given as "books.title".
+func (r *Registrar) Filterable(fields ...string) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	reg.FilterableFields = addKeys(reg.FilterableFields, fields)
+	return r
+}
+
+// FilterableForRole lists the fields the role can filter on. A user who has this role to any record
+// of the type gets a 400 when filtering by any other field.
+func (r *Registrar) FilterableForRole(role userrole.UserRole, fields ...string) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	if reg.RoleFilterableFields == nil {
+		reg.RoleFilterableFields = make(map[userrole.UserRole]map[string]bool)
+	}
+	reg.RoleFilterableFields[role] = addKeys(reg.RoleFilterableFields[role], fields)
+	return r
+}
+
+// Sortable lists the fields (JSON keys) which can be used in orderby, others get a 400.
+func (r *Registrar) Sortable(fields ...string) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	reg.SortableFields = addKeys(reg.SortableFields, fields)
+	return r
+}
+
+// SortableForRole lists the fields the role can sort by, like FilterableForRole
+func (r *Registrar) SortableForRole(role userrole.UserRole, fields ...string) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	if reg.RoleSortableFields == nil {
+		reg.RoleSortableFields = make(map[userrole.UserRole]map[string]bool)
+	}
+	reg.RoleSortableFields[role] = addKeys(reg.RoleSortableFields[role], fields)
+	return r
+}
+
+// CustomURLParams lists URL parameters which aren't fields, so they're not rejected
+// when Filterable is used. (Such as parameters read by hooks)
+func (r *Registrar) CustomURLParams(keys ...string) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	reg.CustomURLParams = addKeys(reg.CustomURLParams, keys)
+	return r
+}
+
+// DefaultLimit is the page size when the client doesn't give a limit
+func (r *Registrar) DefaultLimit(limit int) *Registrar {
+	ModelRegistry[r.currentTypeString].DefaultLimit = limit
+	return r
+}
+
+// MaxLimit is the largest page size, a larger limit (or limit=0) is lowered to this
+func (r *Registrar) MaxLimit(limit int) *Registrar {
+	ModelRegistry[r.currentTypeString].MaxLimit = limit
+	return r
+}
+
+// MaxFilters is the maximum number of filter clauses in the URL query
+func (r *Registrar) MaxFilters(n int) *Registrar {
+	ModelRegistry[r.currentTypeString].MaxFilters = n
+	return r
+}
+
+// MaxLatestN is the maximum latestn
+func (r *Registrar) MaxLatestN(n int) *Registrar {
+	ModelRegistry[r.currentTypeString].MaxLatestN = n
+	return r
+}
+
+// MaxPreloadDepth is the maximum levels of associations loaded for GET, ?preload=all included
+func (r *Registrar) MaxPreloadDepth(n int) *Registrar {
+	ModelRegistry[r.currentTypeString].MaxPreloadDepth = n
+	return r
+}
+
+// Upsert lets PUT create the records which don't exist yet (create permission and create hooks apply to them).
+// naturalKey, if given, are the JSON keys of a unique key; batch PUT uses it to find the existing records
+// when the ID isn't in the JSON.
+func (r *Registrar) Upsert(naturalKey ...string) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	reg.Upsert = true
+	reg.NaturalKey = naturalKey
 	return r
 }
 
 // Hook adds the handler (contains one or more hooks) to be instantiate when a REST op occurs.
 // If any hook exists, old model-based hookpoints and batch hookpoints are not called
+// method is any combination of CRUPD, plus S for restore and X for purge
 func (r *Registrar) Hook(hdlr hook.IHook, method string, args ...interface{}) *Registrar {
 	if ModelRegistry[r.currentTypeString].HandlerMap == nil {
-		ModelRegistry[r.currentTypeString].HandlerMap = handlermap.NewHandlerMap()
+		ModelRegistry[r.currentTypeString].HandlerMap = newHandlerMap()
 	}
 
 	ModelRegistry[r.currentTypeString].HandlerMap.RegisterHandler(hdlr, method, args...)
 	return r
 }
 
+// NoGlobalHook opts out of the global hooks of these types (RegGlobalHook), or all of them
+// if none is given. It applies to global hooks registered later too.
+func (r *Registrar) NoGlobalHook(hdlrs ...hook.IHook) *Registrar {
+	reg := ModelRegistry[r.currentTypeString]
+	types := make([]reflect.Type, len(hdlrs))
+	for i, hdlr := range hdlrs {
+		types[i] = reflect.TypeOf(hdlr).Elem()
+	}
+
+	if len(types) == 0 {
+		reg.NoGlobalHooks = true
+	}
+	reg.NoGlobalHookTypes = append(reg.NoGlobalHookTypes, types...)
+
+	if reg.HandlerMap != nil {
+		reg.HandlerMap.RemoveGlobalHandlers(types...)
+	}
+	return r
+}
+
 // Guard register guard function
 func (r *Registrar) Guard(guard func(ep *hook.EndPoint) *webrender.RetError) *Registrar {
 	ModelRegistry[r.currentTypeString].GuardMethods = append(ModelRegistry[r.currentTypeString].GuardMethods, guard)
@@ -312,13 +455,38 @@ func checkFieldsThatAreStructsForBetterTags(modelObj mdl.IModel, checked map[str
 	// return nil
 }
 
+func addKeys(m map[string]bool, keys []string) map[string]bool {
+	if m == nil {
+		m = make(map[string]bool)
+	}
+	for _, key := range keys {
+		m[key] = true
+	}
+	return m
+}
+
+// jsonKeysOfFieldsTaggedWith returns the JSON keys of fields with the betterrest tag value
+func jsonKeysOfFieldsTaggedWith(modelObj mdl.IModel, tagValue string) []string {
+	keys := make([]string, 0)
+	for _, fieldName := range mdlutil.GetFieldNamesFromModelByTagKey(modelObj, tagValue) {
+		field, _ := reflect.TypeOf(modelObj).Elem().FieldByName(fieldName)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "" {
+			key = fieldName
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 func checkBetterTagValueIsValid(tagVal, fieldName, modelName string) {
 	pairs := strings.Split(tagVal, ";")
 	for _, pair := range pairs {
 		if pair != "peg" && !strings.HasPrefix(pair, "pegassoc") &&
 			!strings.HasPrefix(pair, "ownership") && !strings.HasPrefix(pair, "org") &&
-			!strings.HasPrefix(pair, "peg-ignore") && !strings.HasPrefix(pair, "pegassoc-manytomany") {
-			panic(fmt.Sprintf("%s in %s struct or array with the exception of UUID should have one of the following tag: peg, pegassoc, pegassoc-manytomany, ownership, org, or peg-ignore", fieldName, modelName))
+			!strings.HasPrefix(pair, "peg-ignore") && !strings.HasPrefix(pair, "pegassoc-manytomany") &&
+			pair != "onDelete:restrict" && pair != "onDelete:cascade" && pair != "onDelete:setnull" {
+			panic(fmt.Sprintf("%s in %s struct or array with the exception of UUID should have one of the following tag: peg, pegassoc, pegassoc-manytomany, ownership, org, or peg-ignore (with optional onDelete:restrict|cascade|setnull)", fieldName, modelName))
 		}
 	}
 }
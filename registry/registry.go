@@ -1,10 +1,13 @@
 package registry
 
 import (
+	"fmt"
 	"reflect"
 
 	"github.com/jinzhu/gorm"
 	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/inject"
+	"github.com/t2wu/betterrest/hook/userrole"
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/model/mappertype"
 	"github.com/t2wu/betterrest/registry/handlermap"
@@ -58,6 +61,36 @@ type Reg struct {
 	IdvMethods   string                //  ID end points, "RUD" for read one, update one, and delete one
 	Mapper       mappertype.MapperType // Custmized mapper, default to datamapper.SharedOwnershipMapper
 
+	// FilterableFields and SortableFields are the JSON keys which can be used in URL query and orderby.
+	// nil means any field can be used. Set by betterrest:"filterable" and betterrest:"sortable" tags
+	// or Registrar's Filterable() and Sortable().
+	FilterableFields map[string]bool
+	SortableFields   map[string]bool
+
+	// RoleFilterableFields and RoleSortableFields restrict the fields further by the user's role to the records.
+	// The query returns 400 if any role the user has to records of this type can't use all the fields in it.
+	RoleFilterableFields map[userrole.UserRole]map[string]bool
+	RoleSortableFields   map[userrole.UserRole]map[string]bool
+
+	// CustomURLParams are URL parameters which are not fields (such as ones used by hooks)
+	// They're allowed when FilterableFields is set
+	CustomURLParams map[string]bool
+
+	// Guardrails for GET, 0 means no limit
+	DefaultLimit int // limit used when the client doesn't give one
+	MaxLimit     int // limit is lowered to this, limit=0 (everything) is not allowed when set
+	MaxFilters   int // maximum number of filter clauses in the URL query
+	MaxLatestN   int // maximum latestn
+
+	// MaxPreloadDepth is how many levels of associations ReadMany loads at most, including
+	// with ?preload. 0 means settings.PreloadMaxDepth.
+	MaxPreloadDepth int
+
+	// Upsert makes PUT create the records which don't exist yet. NaturalKey (JSON keys) is used
+	// to find the existing record when the ID isn't given. Set by Registrar's Upsert().
+	Upsert     bool
+	NaturalKey []string
+
 	// // Begin deprecated
 	// BeforeCUPD func(bhpData mdlutil.BatchHookPointData, op mdlutil.CRUPDOp) error // no R since model doens't exist yet
 	// AfterCRUPD func(bhpData mdlutil.BatchHookPointData, op mdlutil.CRUPDOp) error
@@ -86,12 +119,54 @@ type Reg struct {
 	// You can register any number of hook to handle the rest process.
 	// When each conncection is intantiated, the hook remain in memory until the REST op is returned
 	// If there are two hook which handles the same method and the same hook, they will both be called.
-	// The calling order is not guaranteed.
+	// They're called in the order registered, unless hook.Priority, hook.RunBefore or hook.RunAfter
+	// is given to Registrar's Hook().
 	HandlerMap *handlermap.HandlerMap
 
+	// NoGlobalHooks opts out of all global hooks, NoGlobalHookTypes of those of the types
+	NoGlobalHooks     bool
+	NoGlobalHookTypes []reflect.Type
+
 	// RendererMethod func(c *gin.Context, data *hook.Data, info *hook.EndPoint, total *int) bool
 }
 
+// IsFilterable tells if the URL query key can be used for filtering
+func (reg *Reg) IsFilterable(key string) bool {
+	if reg.FilterableFields == nil {
+		return true
+	}
+	return reg.FilterableFields[key] || reg.CustomURLParams[key]
+}
+
+// IsSortable tells if the field can be used in orderby
+func (reg *Reg) IsSortable(key string) bool {
+	if reg.SortableFields == nil {
+		return true
+	}
+	return reg.SortableFields[key]
+}
+
+// RolePermitsFields tells if the role can filter and sort by these fields
+func (reg *Reg) RolePermitsFields(role userrole.UserRole, filterKeys []string, sortKeys []string) bool {
+	if fields, ok := reg.RoleFilterableFields[role]; ok {
+		for _, key := range filterKeys {
+			if !fields[key] && !reg.CustomURLParams[key] {
+				return false
+			}
+		}
+	}
+
+	if fields, ok := reg.RoleSortableFields[role]; ok {
+		for _, key := range sortKeys {
+			if !fields[key] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
 // func (g *Gateway) AfterCreateDB(db *gorm.DB, typeString string) error {
 
 /*
@@ -171,3 +246,44 @@ func NewSliceFromDBByType(modelType reflect.Type, f func(interface{}, ...interfa
 }
 
 // -------------------
+
+func (reg *Reg) optsOutOfGlobalHook(hdlr hook.IHook) bool {
+	if reg.NoGlobalHooks {
+		return true
+	}
+	for _, typ := range reg.NoGlobalHookTypes {
+		if typ == reflect.TypeOf(hdlr).Elem() {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckInjection returns an error if a hook of any model has a betterrest:"inject" field which
+// nothing is provided for
+func CheckInjection() error {
+	for typeString, reg := range ModelRegistry {
+		if reg.HandlerMap == nil {
+			continue
+		}
+		for _, typ := range reg.HandlerMap.Types() {
+			if err := inject.Check(typ); err != nil {
+				return fmt.Errorf("%s: %s", typeString, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckHookOrder returns an error if the hooks of any model are ordered in a cycle
+func CheckHookOrder() error {
+	for typeString, reg := range ModelRegistry {
+		if reg.HandlerMap == nil {
+			continue
+		}
+		if err := reg.HandlerMap.CheckOrder(); err != nil {
+			return fmt.Errorf("%s: %s", typeString, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/render"
+	"github.com/t2wu/betterrest/db"
+	"github.com/t2wu/betterrest/libs/webrender"
+	"github.com/t2wu/betterrest/registry"
+	"github.com/t2wu/qry/datatype"
+)
+
+// AuditHandler returns a Gin handler which reads the audit log, newest first, for those
+// IsAuditAdmin lets through. It can be filtered by typeString, id (of the record) and userId.
+// e.g. GET /betterrest/audit?typeString=Lock&id=...&offset=0&limit=20
+func AuditHandler() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		w, r := c.Writer, c.Request
+
+		if IsAuditAdmin == nil || !IsAuditAdmin(WhoFromContext(r)) {
+			err := errors.New("not an audit admin")
+			render.Render(w, r, webrender.NewErrPermissionDeniedForAPIEndpoint(err))
+			return
+		}
+
+		values := r.URL.Query()
+		offset, limit, err := LimitAndOffsetFromQueryString(&values)
+		if err != nil {
+			render.Render(w, r, webrender.NewErrQueryParameter(err))
+			return
+		}
+
+		q := db.Shared().Model(&registry.BetterRESTAudit{})
+		if typeString := values.Get("typeString"); typeString != "" {
+			q = q.Where("type_string = ?", typeString)
+		}
+		for param, column := range map[string]string{"id": "model_id", "userId": "user_id"} {
+			if v := values.Get(param); v != "" {
+				id, err := datatype.NewUUIDFromString(v)
+				if err != nil {
+					render.Render(w, r, webrender.NewErrQueryParameter(err))
+					return
+				}
+				q = q.Where(column+" = ?", id)
+			}
+		}
+
+		var total int
+		if err := q.Count(&total).Error; err != nil {
+			render.Render(w, r, webrender.NewErrDBError(err))
+			return
+		}
+
+		q = q.Order("created_at DESC")
+		if offset != nil && limit != nil && *limit != 0 {
+			q = q.Offset(*offset).Limit(*limit)
+		}
+
+		entries := make([]registry.BetterRESTAudit, 0)
+		if err := q.Find(&entries).Error; err != nil {
+			render.Render(w, r, webrender.NewErrDBError(err))
+			return
+		}
+
+		data, err := json.Marshal(entries)
+		if err != nil {
+			render.Render(w, r, webrender.NewErrGenJSON(err))
+			return
+		}
+
+		bytes := []byte(fmt.Sprintf(`{ "code": 0, "total": %d, "content": %s }`, total, string(data)))
+		c.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		c.Writer.Header().Set("Cache-Control", "no-store")
+		c.Writer.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+		c.Writer.Write(bytes)
+	}
+}
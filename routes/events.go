@@ -0,0 +1,397 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/render"
+	"github.com/t2wu/betterrest/datamapper"
+	"github.com/t2wu/betterrest/db"
+	"github.com/t2wu/betterrest/hook"
+	"github.com/t2wu/betterrest/hook/event"
+	"github.com/t2wu/betterrest/hook/notify"
+	"github.com/t2wu/betterrest/hook/rest"
+	"github.com/t2wu/betterrest/hook/tools"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/betterrest/libs/urlparam"
+	"github.com/t2wu/betterrest/libs/webrender"
+	"github.com/t2wu/betterrest/lifecycle"
+	"github.com/t2wu/betterrest/model/mappertype"
+	"github.com/t2wu/betterrest/registry"
+)
+
+// EventsListener, if set, is where /events gets the writes from, so the writes of every instance
+// are streamed. Otherwise it's the writes of this instance only (hook/event). Set it before adding
+// the routes.
+var EventsListener *notify.Listener
+
+// EventsBuffer is how many writes a stream can fall behind before it's told to resync
+var EventsBuffer = 100
+
+// EventsInterval is how often a stream reads the records written since its last read. Writes in
+// between are read together, so a stream reads at most once per interval however busy the type is.
+var EventsInterval = time.Second
+
+// EventsMaxIDs is the most records a stream reads at a time. With more it's told to resync instead.
+var EventsMaxIDs = 1000
+
+// EventsKeepAlive is how often a comment is sent so proxies don't close an idle stream
+var EventsKeepAlive = 30 * time.Second
+
+// eventsKnownIDs is how many IDs a stream remembers having sent, for deletes
+const eventsKnownIDs = 10000
+
+var eventNames = map[rest.Op]string{
+	rest.OpCreate:  "create",
+	rest.OpUpdate:  "update",
+	rest.OpPatch:   "patch",
+	rest.OpDelete:  "delete",
+	rest.OpRestore: "restore",
+	rest.OpPurge:   "purge",
+}
+
+// EventsHandler returns a Gin handler which streams the committed writes of typeString as
+// Server-Sent Events, e.g. GET /locks/events?status=locked
+// The records written are read again as the connected user with the URL filters, so only those
+// the user can read and which match are sent. A deleted record can't be read, so a delete (or
+// purge) is only sent for the records the stream has sent before. A record sent before which no
+// longer matches after a write is sent as a delete too.
+// Partitioned types need cstart and cstop as in GET, and only records created within them are sent.
+func EventsHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		w, r := c.Writer, c.Request
+
+		if settings.Log {
+			log.Printf("[BetterREST]: %s %s (events), transact: n/a\n", c.Request.Method, c.Request.URL.String())
+		}
+
+		// Paging doesn't apply, the records written are all read
+		options := make(map[urlparam.Param]interface{})
+		for k, v := range OptionFromContext(r) {
+			options[k] = v
+		}
+		delete(options, urlparam.ParamOffset)
+		delete(options, urlparam.ParamLimit)
+		delete(options, urlparam.ParamHasTotalCount)
+
+		if registry.ModelRegistry[typeString].Mapper == mappertype.UnderOrgPartition {
+			_, _, cstart, cstop, _, _, _, _, _ := urlparam.GetOptions(options)
+			if cstart == nil || cstop == nil {
+				err := fmt.Errorf("GET /%s/events needs cstart and cstop parameters", strings.ToLower(typeString))
+				render.Render(w, r, webrender.NewErrQueryParameter(err))
+				return
+			}
+		}
+
+		ep := hook.EndPoint{
+			URL:         c.Request.URL.String(),
+			Op:          rest.OpRead,
+			Cardinality: rest.CardinalityMany,
+			TypeString:  typeString,
+			URLParams:   options,
+			Who:         WhoFromContext(r),
+		}
+
+		writes := make(chan written, EventsBuffer)
+		var behind int32
+		unsubscribe := subscribeWritten(typeString, func(wr written) {
+			select {
+			case writes <- wr:
+			default:
+				atomic.StoreInt32(&behind, 1)
+			}
+		})
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // for nginx
+		w.WriteHeader(200)
+		w.Flush()
+
+		known := newIDSet(eventsKnownIDs)
+		pending := newPendingWrites()
+		resync := false
+		keepAlive := time.NewTicker(EventsKeepAlive)
+		defer keepAlive.Stop()
+		interval := time.NewTicker(EventsInterval)
+		defer interval.Stop()
+
+		for {
+			var msg string
+			select {
+			case <-r.Context().Done():
+				return
+			case wr := <-writes:
+				if wr.resync {
+					resync = true
+				} else {
+					pending.add(wr.op, wr.ids)
+				}
+				if len(pending.order) > EventsMaxIDs {
+					resync = true
+				}
+				continue
+			case <-keepAlive.C:
+				msg = ": keep-alive\n\n"
+			case <-interval.C:
+				// Writes were dropped, the client should read again
+				if atomic.CompareAndSwapInt32(&behind, 1, 0) || resync {
+					resync = false
+					pending = newPendingWrites()
+					msg = "event: resync\ndata: {}\n\n"
+					break
+				}
+
+				if len(pending.order) == 0 {
+					continue
+				}
+				var err error
+				msg, err = pendingMessage(mapper, &ep, pending, known)
+				pending = newPendingWrites()
+				if err != nil {
+					log.Println("events:", typeString, err)
+					continue
+				}
+			}
+
+			if msg == "" {
+				continue
+			}
+			if _, err := w.WriteString(msg); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
+
+// written is a committed write as a stream gets it, from hook/event or hook/notify
+type written struct {
+	op     rest.Op
+	ids    []string
+	resync bool // the records are unknown, the client should read again
+}
+
+// subscribeWritten calls fn for every committed write of typeString, from EventsListener if there
+// is one or else from hook/event. Returns the function to unsubscribe.
+func subscribeWritten(typeString string, fn func(wr written)) func() {
+	if EventsListener != nil {
+		return listenerFanOut(typeString).add(fn)
+	}
+
+	sub := event.Subscribe(typeString, func(e *event.Event) {
+		ids := make([]string, len(e.IDs))
+		for i, id := range e.IDs {
+			ids[i] = id.String()
+		}
+		fn(written{op: e.Op, ids: ids})
+	})
+	return sub.Unsubscribe
+}
+
+// writtenFanOut passes the notifications of a type on to its streams, since a subscription to
+// notify.Listener can't be removed
+type writtenFanOut struct {
+	mu   sync.RWMutex
+	next int
+	fns  map[int]func(wr written)
+}
+
+var (
+	fanOutsMu sync.Mutex
+	fanOuts   = make(map[string]*writtenFanOut)
+)
+
+// listenerFanOut is the fan-out of typeString, subscribed to EventsListener the first time
+func listenerFanOut(typeString string) *writtenFanOut {
+	fanOutsMu.Lock()
+	defer fanOutsMu.Unlock()
+
+	f, ok := fanOuts[typeString]
+	if !ok {
+		f = &writtenFanOut{fns: make(map[int]func(wr written))}
+		fanOuts[typeString] = f
+		EventsListener.Subscribe(typeString, func(ev notify.Event) {
+			// Truncated events don't have the IDs
+			f.send(written{op: ev.Op, ids: ev.IDs, resync: ev.Resync || ev.Truncated})
+		})
+	}
+	return f
+}
+
+func (f *writtenFanOut) add(fn func(wr written)) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := f.next
+	f.next++
+	f.fns[key] = fn
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.fns, key)
+	}
+}
+
+func (f *writtenFanOut) send(wr written) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, fn := range f.fns {
+		fn(wr)
+	}
+}
+
+// pendingWrites is the last op on each record written since the last read, in order
+type pendingWrites struct {
+	ops   map[string]rest.Op
+	order []string
+}
+
+func newPendingWrites() *pendingWrites {
+	return &pendingWrites{ops: make(map[string]rest.Op), order: make([]string, 0)}
+}
+
+func (p *pendingWrites) add(op rest.Op, ids []string) {
+	for _, id := range ids {
+		prev, ok := p.ops[id]
+		if !ok {
+			p.order = append(p.order, id)
+		} else if prev == rest.OpCreate && (op == rest.OpUpdate || op == rest.OpPatch) {
+			continue // still new to the client
+		}
+		p.ops[id] = op
+	}
+}
+
+// pendingMessage is the SSE messages of the pending writes for this stream, "" if nothing in it is to
+// be sent. The records which are still there are read in one go.
+func pendingMessage(mapper datamapper.IDataMapper, ep *hook.EndPoint, pending *pendingWrites, known *idSet) (string, error) {
+	// Deleted ones can't be read, sent if the stream has sent them before
+	deleted := make(map[rest.Op][]string)
+	onlyIDs := make([]string, 0, len(pending.order))
+	for _, id := range pending.order {
+		op := pending.ops[id]
+		if _, ok := eventNames[op]; !ok {
+			continue
+		}
+		if op == rest.OpDelete || op == rest.OpPurge {
+			if known.has(id) {
+				known.remove(id)
+				deleted[op] = append(deleted[op], strconv.Quote(id))
+			}
+		} else {
+			onlyIDs = append(onlyIDs, id)
+		}
+	}
+
+	msg := ""
+	for _, op := range []rest.Op{rest.OpDelete, rest.OpPurge} {
+		if len(deleted[op]) != 0 {
+			msg += fmt.Sprintf("event: %s\ndata: { \"ids\": [%s] }\n\n", eventNames[op], strings.Join(deleted[op], ","))
+		}
+	}
+	if len(onlyIDs) == 0 {
+		return msg, nil
+	}
+
+	// Read them as the user with the filters of the stream
+	epRead := *ep
+	epRead.URLParams = make(map[urlparam.Param]interface{}, len(ep.URLParams)+3)
+	for k, v := range ep.URLParams {
+		epRead.URLParams[k] = v
+	}
+	epRead.URLParams[urlparam.ParamOnlyIDs] = onlyIDs
+	epRead.URLParams[urlparam.ParamOffset] = 0
+	epRead.URLParams[urlparam.ParamLimit] = len(onlyIDs)
+
+	data, _, _, errRenderer := lifecycle.ReadMany(db.Shared(), mapper, &epRead, nil, nil)
+	if errRenderer != nil {
+		return "", fmt.Errorf("reading the records written: %v", errRenderer)
+	}
+
+	read := make(map[string]bool, len(data.Ms))
+	ids := make(map[rest.Op][]string)
+	contents := make(map[rest.Op][]string)
+	for i, modelObj := range data.Ms {
+		content, err := tools.ToJSON(modelObj, data.Roles[i], ep.Who)
+		if err != nil {
+			return "", err
+		}
+
+		id := modelObj.GetID().String()
+		read[id] = true
+		op := pending.ops[id]
+		ids[op] = append(ids[op], strconv.Quote(id))
+		contents[op] = append(contents[op], string(content))
+	}
+
+	// Sent before but not matching (or readable) anymore, the client should remove them
+	gone := make([]string, 0)
+	for _, id := range onlyIDs {
+		if known.has(id) && !read[id] {
+			known.remove(id)
+			gone = append(gone, strconv.Quote(id))
+		}
+	}
+	if len(gone) != 0 {
+		msg += fmt.Sprintf("event: %s\ndata: { \"ids\": [%s] }\n\n", eventNames[rest.OpDelete], strings.Join(gone, ","))
+	}
+
+	for id := range read {
+		known.add(id)
+	}
+	for _, op := range []rest.Op{rest.OpCreate, rest.OpUpdate, rest.OpPatch, rest.OpRestore} {
+		if len(ids[op]) != 0 {
+			msg += fmt.Sprintf("event: %s\ndata: { \"ids\": [%s], \"content\": [%s] }\n\n", eventNames[op],
+				strings.Join(ids[op], ","), strings.Join(contents[op], ","))
+		}
+	}
+	return msg, nil
+}
+
+// idSet remembers up to n IDs, forgetting the oldest
+type idSet struct {
+	n     int
+	ids   map[string]bool
+	order []string
+}
+
+func newIDSet(n int) *idSet {
+	return &idSet{n: n, ids: make(map[string]bool), order: make([]string, 0)}
+}
+
+func (s *idSet) add(id string) {
+	if s.ids[id] {
+		return
+	}
+	if len(s.order) == s.n {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+}
+
+func (s *idSet) remove(id string) {
+	if !s.ids[id] {
+		return
+	}
+	delete(s.ids, id)
+	for i, id2 := range s.order {
+		if id2 == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *idSet) has(id string) bool {
+	return s.ids[id]
+}
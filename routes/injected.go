@@ -9,3 +9,6 @@ import (
 // Register Who handler
 // func WhoFromContext(r *http.Request) mdl.Who
 var WhoFromContext func(r *http.Request) mdlutil.UserIDFetchable
+
+// IsAuditAdmin tells if the user can read the audit log, nobody can if it's not registered
+var IsAuditAdmin func(who mdlutil.UserIDFetchable) bool
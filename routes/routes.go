@@ -4,6 +4,9 @@ import (
 	"strings"
 
 	"github.com/t2wu/betterrest/datamapper"
+	"github.com/t2wu/betterrest/hook/outbox"
+	"github.com/t2wu/betterrest/libs/settings"
+	"github.com/t2wu/betterrest/mdlutil"
 	"github.com/t2wu/betterrest/model/mappertype"
 	"github.com/t2wu/betterrest/registry"
 
@@ -17,6 +20,12 @@ func addRoute(r *gin.Engine, typeString string, reg *registry.Reg, mapper datama
 		if strings.ContainsAny(reg.BatchMethods, "R") {
 			g.GET("", w(GuardMiddleWare(typeString)),
 				w(ReadManyHandler(typeString, mapper))) // e.g. GET /devices
+
+			g.GET("/distinct/:field", w(GuardMiddleWare(typeString)),
+				w(ReadDistinctHandler(typeString, mapper))) // e.g. GET /devices/distinct/model
+
+			g.GET("/events", w(GuardMiddleWare(typeString)),
+				w(EventsHandler(typeString, mapper))) // e.g. GET /devices/events, Server-Sent Events
 		}
 
 		if strings.ContainsAny(reg.BatchMethods, "C") {
@@ -45,6 +54,11 @@ func addRoute(r *gin.Engine, typeString string, reg *registry.Reg, mapper datama
 				// r.Use(OneMiddleWare(typeString))
 				n.GET("", w(GuardMiddleWare(typeString)),
 					w(ReadOneHandler(typeString, mapper))) // e.g. GET /model/123
+
+				if settings.Audit {
+					n.GET("/history", w(GuardMiddleWare(typeString)),
+						w(HistoryHandler(typeString, mapper))) // e.g. GET /model/123/history
+				}
 			}
 
 			if strings.ContainsAny(reg.IdvMethods, "U") {
@@ -60,6 +74,14 @@ func addRoute(r *gin.Engine, typeString string, reg *registry.Reg, mapper datama
 			if strings.ContainsAny(reg.IdvMethods, "D") {
 				n.DELETE("", w(GuardMiddleWare(typeString)),
 					w(DeleteOneHandler(typeString, mapper))) // e.g. DELETE /model/123
+
+				// Soft-deleted models can be restored or purged
+				if m, ok := registry.NewFromTypeString(typeString).(mdlutil.IDoRealDelete); ok && !m.DoRealDelete() {
+					n.POST("/restore", w(GuardMiddleWare(typeString)),
+						w(RestoreOneHandler(typeString, mapper))) // e.g. POST /model/123/restore
+					n.DELETE("/purge", w(GuardMiddleWare(typeString)),
+						w(PurgeOneHandler(typeString, mapper))) // e.g. DELETE /model/123/purge
+				}
 			}
 		}
 	}
@@ -67,7 +89,22 @@ func addRoute(r *gin.Engine, typeString string, reg *registry.Reg, mapper datama
 
 // AddRESTRoutes adds all routes
 func AddRESTRoutes(r *gin.Engine) {
+	if err := registry.CheckHookOrder(); err != nil {
+		panic(err)
+	}
+	if err := registry.CheckInjection(); err != nil {
+		panic(err)
+	}
+	if err := outbox.CheckStarted(); err != nil {
+		panic(err)
+	}
+
 	registry.CreateBetterRESTTable()
+	if settings.Audit {
+		registry.CreateBetterRESTAuditTable()
+		r.GET("/betterrest/audit", w(AuditHandler())) // for who IsAuditAdmin lets through
+	}
+
 	for typestring, reg := range registry.ModelRegistry {
 		var dm datamapper.IDataMapper
 		switch reg.Mapper {
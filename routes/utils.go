@@ -2,7 +2,9 @@ package routes
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-chi/render"
@@ -78,7 +80,7 @@ func GuardMiddleWare(typeString string) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		w, r := c.Writer, c.Request
 
-		options, err := GetOptionByParsingURL(c.Request)
+		options, err := GetOptionByParsingURLForType(c.Request, typeString)
 		if err != nil {
 			render.Render(w, r, webrender.NewErrQueryParameter(err))
 			c.Abort() // abort
@@ -86,11 +88,25 @@ func GuardMiddleWare(typeString string) func(c *gin.Context) {
 		}
 		OptionToContext(c, options)
 
+		// asOf is only for reading one record, e.g. GET /model/123?asOf=...
+		if _, ok := options[urlparam.ParamAsOf]; ok && (r.Method != http.MethodGet || !strings.HasSuffix(c.FullPath(), "/:id")) {
+			render.Render(w, r, webrender.NewErrQueryParameter(errors.New("asOf only works when reading one record")))
+			c.Abort() // abort
+			return
+		}
+
 		who := WhoFromContext(r)
 
+		op := rest.HTTPMethodToRESTOp(r.Method)
+		if strings.HasSuffix(c.FullPath(), "/restore") {
+			op = rest.OpRestore
+		} else if strings.HasSuffix(c.FullPath(), "/purge") {
+			op = rest.OpPurge
+		}
+
 		ep := hook.EndPoint{
 			URL:         c.Request.URL.String(),
-			Op:          rest.HTTPMethodToRESTOp(r.Method),
+			Op:          op,
 			Cardinality: rest.CardinalityOne,
 			TypeString:  typeString,
 			URLParams:   options,
@@ -26,6 +26,7 @@ import (
 	"github.com/t2wu/betterrest/libs/webrender"
 	"github.com/t2wu/betterrest/lifecycle"
 	"github.com/t2wu/betterrest/mdlutil"
+	"github.com/t2wu/betterrest/registry"
 	"github.com/t2wu/qry/mdl"
 
 	"github.com/gin-gonic/gin"
@@ -134,33 +135,149 @@ func LatestnOnFromQueryString(values *url.Values) []string {
 	return (*values)[string(urlparam.ParamLatestNOn)]
 }
 
+// TopNFromQueryString parses topn, topnon, topnby and topnorder. topnby defaults to createdAt
+// and topnorder defaults to desc.
+func TopNFromQueryString(values *url.Values) (*urlparam.TopN, error) {
+	defer delete(*values, string(urlparam.ParamTopN))
+	defer delete(*values, string(urlparam.ParamTopNOn))
+	defer delete(*values, string(urlparam.ParamTopNBy))
+	defer delete(*values, string(urlparam.ParamTopNOrder))
+
+	n := values.Get(string(urlparam.ParamTopN))
+	if n == "" {
+		return nil, nil
+	}
+
+	topn := urlparam.TopN{By: "createdAt", Desc: true, ByDefault: true}
+	var err error
+	if topn.N, err = strconv.Atoi(n); err != nil || topn.N <= 0 {
+		return nil, errors.New("topn should be a positive integer")
+	}
+
+	topn.On = (*values)[string(urlparam.ParamTopNOn)]
+	if len(topn.On) == 0 {
+		return nil, errors.New("use topnon with topn")
+	}
+
+	if by := values.Get(string(urlparam.ParamTopNBy)); by != "" {
+		topn.By = by // checked against the model in datamapper
+		topn.ByDefault = false
+	}
+
+	switch values.Get(string(urlparam.ParamTopNOrder)) {
+	case "", "desc":
+	case "asc":
+		topn.Desc = false
+	default:
+		return nil, errors.New("topnorder should be asc or desc")
+	}
+
+	return &topn, nil
+}
+
+func SearchFromQueryString(values *url.Values) *string {
+	defer delete(*values, string(urlparam.ParamSearch))
+
+	if search := strings.TrimSpace(values.Get(string(urlparam.ParamSearch))); search != "" {
+		return &search // it's a bound variable in the query so no injection
+	}
+	return nil
+}
+
+// CreatedTimeRangeFromQueryString parses cstart and cstop. Either one can be left out for an
+// open-ended range, they are filled in with 0 and now respectively
 func CreatedTimeRangeFromQueryString(values *url.Values) (*int, *int, error) {
 	defer delete(*values, string(urlparam.ParamCstart))
 	defer delete(*values, string(urlparam.ParamCstop))
 
-	if cstart, cstop := values.Get(string(urlparam.ParamCstart)),
-		values.Get(string(urlparam.ParamCstop)); cstart != "" && cstop != "" {
-		var err error
-		cStartInt, cStopInt := 0, 0
-		if cstart != "" {
-			if cStartInt, err = strconv.Atoi(cstart); err != nil {
-				return nil, nil, err
-			}
+	cstart, cstop := values.Get(string(urlparam.ParamCstart)), values.Get(string(urlparam.ParamCstop))
+	if cstart == "" && cstop == "" {
+		return nil, nil, nil
+	}
+
+	cStartInt, cStopInt := 0, int(time.Now().Unix()) // from the beginning to now
+	if cstart != "" {
+		t, err := timeFromQueryValue(string(urlparam.ParamCstart), cstart)
+		if err != nil {
+			return nil, nil, err
+		}
+		cStartInt = int(t.Unix())
+	}
+
+	if cstop != "" {
+		t, err := timeFromQueryValue(string(urlparam.ParamCstop), cstop)
+		if err != nil {
+			return nil, nil, err
+		}
+		cStopInt = int(t.Unix())
+	}
+
+	if cStartInt > cStopInt {
+		return nil, nil, errors.New("cstart should not be later than cstop")
+	}
+
+	return &cStartInt, &cStopInt, nil
+}
+
+// TimeRangesFromQueryString parses time ranges on any time field, such as
+// updatedAt.start=2021-01-01T00:00:00+08:00&updatedAt.stop=2021-02-01T00:00:00+08:00
+// Either one can be left out for an open-ended range. Whether the field exists is checked by the mapper.
+func TimeRangesFromQueryString(values *url.Values) ([]urlparam.TimeRange, error) {
+	ranges := make([]urlparam.TimeRange, 0)
+	indices := make(map[string]int)
+	for key := range *values {
+		var fieldName string
+		var isStart bool
+		if strings.HasSuffix(key, ".start") {
+			fieldName, isStart = strings.TrimSuffix(key, ".start"), true
+		} else if strings.HasSuffix(key, ".stop") {
+			fieldName, isStart = strings.TrimSuffix(key, ".stop"), false
 		} else {
-			cStartInt = 0
+			continue
 		}
 
-		if cstop != "" {
-			if cStopInt, err = strconv.Atoi(cstop); err != nil {
-				return nil, nil, err
-			}
+		t, err := timeFromQueryValue(key, values.Get(key))
+		if err != nil {
+			return nil, err
+		}
+
+		idx, ok := indices[fieldName]
+		if !ok {
+			ranges = append(ranges, urlparam.TimeRange{FieldName: fieldName})
+			idx = len(ranges) - 1
+			indices[fieldName] = idx
+		}
+
+		if isStart {
+			ranges[idx].Start = &t
 		} else {
-			cStopInt = int(time.Now().Unix()) // now
+			ranges[idx].Stop = &t
 		}
+	}
 
-		return &cStartInt, &cStopInt, nil
+	for _, r := range ranges {
+		delete(*values, r.FieldName+".start")
+		delete(*values, r.FieldName+".stop")
+		if r.Start != nil && r.Stop != nil && r.Start.After(*r.Stop) {
+			return nil, fmt.Errorf("%s.start should not be later than %s.stop", r.FieldName, r.FieldName)
+		}
 	}
-	return nil, nil, nil
+
+	return ranges, nil
+}
+
+// timeFromQueryValue accepts unix seconds or RFC 3339
+func timeFromQueryValue(key, value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	// An unescaped "+" in the timezone comes in as a space
+	t, err := time.Parse(time.RFC3339, strings.Replace(strings.TrimSpace(value), " ", "+", 1))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s should be unix seconds or RFC 3339 time (e.g. 2006-01-02T15:04:05+08:00), got %s", key, value)
+	}
+	return t, nil
 }
 
 func hasTotalCountFromQueryString(values *url.Values) bool {
@@ -171,6 +288,50 @@ func hasTotalCountFromQueryString(values *url.Values) bool {
 	return false
 }
 
+// PreloadFromQueryString parses preload, which is none, all, or a comma-separated list
+// of associations such as locations,locations.doors
+func PreloadFromQueryString(values *url.Values) (*urlparam.Preload, error) {
+	defer delete(*values, string(urlparam.ParamPreload))
+
+	switch preload := values.Get(string(urlparam.ParamPreload)); preload {
+	case "":
+		return nil, nil
+	case "none":
+		return &urlparam.Preload{}, nil
+	case "all":
+		return &urlparam.Preload{All: true}, nil
+	default:
+		paths := strings.Split(preload, ",")
+		for i, path := range paths {
+			paths[i] = strings.TrimSpace(path)
+			if paths[i] == "" {
+				return nil, errors.New("preload should be none, all, or a list of associations")
+			}
+		}
+		return &urlparam.Preload{Paths: paths}, nil
+	}
+}
+
+// asOfFromQueryString parses asOf, which reads a record as it was at that time
+func asOfFromQueryString(values *url.Values) (*time.Time, error) {
+	defer delete(*values, string(urlparam.ParamAsOf))
+	asOf := values.Get(string(urlparam.ParamAsOf))
+	if asOf == "" {
+		return nil, nil
+	}
+
+	t, err := timeFromQueryValue(string(urlparam.ParamAsOf), asOf)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func includeDeletedFromQueryString(values *url.Values) bool {
+	defer delete(*values, string(urlparam.ParamIncludeDeleted))
+	return values.Get(string(urlparam.ParamIncludeDeleted)) == "true"
+}
+
 func modelObjsToJSON(modelObjs []mdl.IModel, roles []userrole.UserRole, who mdlutil.UserIDFetchable) (string, error) {
 	arr := make([]string, len(modelObjs))
 	for i, v := range modelObjs {
@@ -196,7 +357,11 @@ func RenderModelSlice(c *gin.Context, data *hook.Data, ep *hook.EndPoint, total
 		}
 	}
 
-	// no custom rendering
+	RenderJSONForModelSlice(c, data, ep, total)
+}
+
+// RenderJSONForModelSlice is the default rendering of RenderModelSlice
+func RenderJSONForModelSlice(c *gin.Context, data *hook.Data, ep *hook.EndPoint, total *int) {
 	jsonString, err := modelObjsToJSON(data.Ms, data.Roles, ep.Who)
 	if err != nil {
 		log.Println("Error in RenderModelSlice:", err)
@@ -204,12 +369,14 @@ func RenderModelSlice(c *gin.Context, data *hook.Data, ep *hook.EndPoint, total
 		return
 	}
 
-	var content string
+	content := `{ "code": 0, `
 	if total != nil {
-		content = fmt.Sprintf(`{ "code": 0, "total": %d, "content": %s }`, *total, jsonString)
-	} else {
-		content = fmt.Sprintf(`{ "code": 0, "content": %s }`, jsonString)
+		content += fmt.Sprintf(`"total": %d, `, *total)
+	}
+	if limit := urlparam.GetLimitApplied(ep.URLParams); limit != nil {
+		content += fmt.Sprintf(`"limit": %d, `, *limit) // so the client knows there may be more
 	}
+	content += fmt.Sprintf(`"content": %s }`, jsonString)
 
 	bytes := []byte(content)
 	c.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -242,6 +409,22 @@ func RenderModel(c *gin.Context, data *hook.Data, ep *hook.EndPoint, total *int,
 	RenderJSONForModel(c, data.Ms[0], data, ep)
 }
 
+// renderUpsert offers an upsert to the Render hooks of create and of update (each with its own
+// Op), so a batch which both created and updated doesn't skip either. Otherwise renderDefault.
+func renderUpsert(c *gin.Context, data *hook.Data, ep *hook.EndPoint, hfs []*hfetcher.HandlerFetcher, renderDefault func()) {
+	for _, hf := range hfs {
+		epOp := *ep
+		epOp.Op = hf.Op()
+		for _, handler := range hf.FetchHandlersForOpAndHook(epOp.Op, "R") {
+			if renderHook, ok := handler.(hook.IRender); ok && renderHook.Render(c, data, &epOp, nil) {
+				return // maximum of one handler at a time
+			}
+		}
+	}
+
+	renderDefault()
+}
+
 func RenderJSONForModel(c *gin.Context, modelObj mdl.IModel, data *hook.Data, ep *hook.EndPoint) {
 	// render.JSON(w, r, modelObj) // cannot use this since no picking the field we need
 	jsonBytes, err := tools.ToJSON(modelObj, data.Roles[0], ep.Who)
@@ -294,6 +477,23 @@ func RenderCodeAndMsg(c *gin.Context, code int, total int, msg *string, err *str
 
 // ---------------------------------------------
 
+// GetOptionByParsingURLForType is GetOptionByParsingURL with the query limits registered
+// for the typeString applied to a GET
+func GetOptionByParsingURLForType(r *http.Request, typeString string) (map[urlparam.Param]interface{}, error) {
+	options, err := GetOptionByParsingURL(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Method == http.MethodGet {
+		if err := applyQueryLimits(typeString, options); err != nil {
+			return nil, err
+		}
+	}
+
+	return options, nil
+}
+
 func GetOptionByParsingURL(r *http.Request) (map[urlparam.Param]interface{}, error) {
 	options := make(map[urlparam.Param]interface{})
 
@@ -321,6 +521,36 @@ func GetOptionByParsingURL(r *http.Request) (map[urlparam.Param]interface{}, err
 		options[urlparam.ParamLatestNOn] = latestnon
 	}
 
+	if topn, err := TopNFromQueryString(&values); err == nil && topn != nil {
+		options[urlparam.ParamTopN] = *topn
+	} else if err != nil {
+		return nil, err
+	} else if latestn, ok := options[urlparam.ParamLatestN].(string); ok {
+		// latestn is topn by createdAt
+		latestnons, _ := options[urlparam.ParamLatestNOn].([]string)
+		if len(latestnons) == 0 && !settings.LegacyLatestN {
+			return nil, errors.New("use latestnon with latestn")
+		}
+		n, _ := strconv.Atoi(latestn) // already checked
+		options[urlparam.ParamTopN] = urlparam.TopN{N: n, On: latestnons, By: "createdAt", Desc: true, ByDefault: true}
+	}
+
+	if search := SearchFromQueryString(&values); search != nil {
+		options[urlparam.ParamSearch] = *search
+	}
+
+	if preload, err := PreloadFromQueryString(&values); err == nil && preload != nil {
+		options[urlparam.ParamPreload] = *preload
+	} else if err != nil {
+		return nil, err
+	}
+
+	if asOf, err := asOfFromQueryString(&values); err == nil && asOf != nil {
+		options[urlparam.ParamAsOf] = *asOf
+	} else if err != nil {
+		return nil, err
+	}
+
 	options[urlparam.ParamOtherQueries] = values
 
 	if cstart, cstop, err := CreatedTimeRangeFromQueryString(&values); err == nil && cstart != nil && cstop != nil {
@@ -329,11 +559,73 @@ func GetOptionByParsingURL(r *http.Request) (map[urlparam.Param]interface{}, err
 		return nil, err
 	}
 
+	if ranges, err := TimeRangesFromQueryString(&values); err == nil && len(ranges) != 0 {
+		options[urlparam.ParamTimeRanges] = ranges
+	} else if err != nil {
+		return nil, err
+	}
+
 	options[urlparam.ParamHasTotalCount] = hasTotalCountFromQueryString(&values)
+	options[urlparam.ParamIncludeDeleted] = includeDeletedFromQueryString(&values)
 
 	return options, nil
 }
 
+// applyQueryLimits enforces the guardrails registered for the typeString
+func applyQueryLimits(typeString string, options map[urlparam.Param]interface{}) error {
+	reg, ok := registry.ModelRegistry[typeString]
+	if !ok {
+		return nil
+	}
+
+	if reg.MaxFilters > 0 {
+		n := len(urlparam.GetTimeRanges(options))
+		if values, ok := options[urlparam.ParamOtherQueries].(url.Values); ok {
+			for key, vals := range values {
+				if !reg.CustomURLParams[key] {
+					n += len(vals)
+				}
+			}
+		}
+		if n > reg.MaxFilters {
+			return fmt.Errorf("too many filters, maximum is %d", reg.MaxFilters)
+		}
+	}
+
+	_, limit, _, _, _, _, _, _, _ := urlparam.GetOptions(options)
+	if topn := urlparam.GetTopN(options); reg.MaxLatestN > 0 && topn != nil && topn.N > reg.MaxLatestN {
+		return fmt.Errorf("latestn (topn) cannot be larger than %d", reg.MaxLatestN)
+	}
+
+	if preload := urlparam.GetPreload(options); reg.MaxPreloadDepth > 0 && preload != nil {
+		for _, path := range preload.Paths {
+			if strings.Count(path, ".")+1 > reg.MaxPreloadDepth {
+				return fmt.Errorf("preload cannot be deeper than %d levels", reg.MaxPreloadDepth)
+			}
+		}
+	}
+
+	applied := 0
+	if limit == nil {
+		applied = reg.DefaultLimit
+		if applied == 0 || (reg.MaxLimit > 0 && applied > reg.MaxLimit) {
+			applied = reg.MaxLimit
+		}
+		if applied > 0 {
+			options[urlparam.ParamOffset] = 0
+		}
+	} else if reg.MaxLimit > 0 && (*limit == 0 || *limit > reg.MaxLimit) {
+		applied = reg.MaxLimit
+	}
+
+	if applied > 0 {
+		options[urlparam.ParamLimit] = applied
+		options[urlparam.ParamLimitApplied] = applied
+	}
+
+	return nil
+}
+
 func w(handler func(c *gin.Context)) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		defer func() {
@@ -427,6 +719,45 @@ func ReadManyHandler(typeString string, mapper datamapper.IDataMapper) func(c *g
 	}
 }
 
+// ReadDistinctHandler returns a Gin handler which counts the distinct values of a field
+// e.g. GET /locks/distinct/model
+func ReadDistinctHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		w, r := c.Writer, c.Request
+
+		if settings.Log {
+			log.Printf("[BetterREST]: %s %s (n), transact: n/a", c.Request.Method, c.Request.URL.String())
+		}
+
+		ep := hook.EndPoint{
+			URL:         c.Request.URL.String(),
+			Op:          rest.OpRead,
+			Cardinality: rest.CardinalityMany,
+			TypeString:  typeString,
+			URLParams:   OptionFromContext(r),
+			Who:         WhoFromContext(r),
+		}
+
+		values, errRenderer := lifecycle.ReadDistinct(db.Shared(), mapper, c.Param("field"), &ep, nil, &TransIDLogger{})
+		if errRenderer != nil {
+			render.Render(w, r, errRenderer)
+			return
+		}
+
+		data, err := json.Marshal(values)
+		if err != nil {
+			render.Render(w, r, webrender.NewErrGenJSON(err))
+			return
+		}
+
+		bytes := []byte(fmt.Sprintf(`{ "code": 0, "content": %s }`, string(data)))
+		c.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		c.Writer.Header().Set("Cache-Control", "no-store")
+		c.Writer.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+		c.Writer.Write(bytes)
+	}
+}
+
 // ReadOneHandler returns a http.Handler which read one resource
 func ReadOneHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
 	// return func(next http.Handler) http.Handler {
@@ -462,6 +793,79 @@ func ReadOneHandler(typeString string, mapper datamapper.IDataMapper) func(c *gi
 	}
 }
 
+// HistoryHandler returns a Gin handler which lists the versions of a record, oldest first,
+// rendered with the role the user has on the record now
+// e.g. GET /model/123/history
+func HistoryHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		w, r := c.Writer, c.Request
+
+		id, httperr := IDFromURLQueryString(c)
+		if httperr != nil {
+			render.Render(w, r, httperr)
+			return
+		}
+
+		if settings.Log {
+			log.Printf("[BetterREST]: %s %s (1), transact: n/a\n", c.Request.Method, c.Request.URL.String())
+		}
+
+		// Read it first for the permission, a deleted one as well
+		// (on a copy of the parameters, which are in the request context)
+		options := make(map[urlparam.Param]interface{})
+		for k, v := range OptionFromContext(r) {
+			options[k] = v
+		}
+		options[urlparam.ParamIncludeDeleted] = true
+
+		ep := hook.EndPoint{
+			URL:         c.Request.URL.String(),
+			Op:          rest.OpRead,
+			Cardinality: rest.CardinalityOne,
+			TypeString:  typeString,
+			URLParams:   options,
+			Who:         WhoFromContext(r),
+		}
+
+		data, _, errRenderer := lifecycle.ReadOne(db.Shared(), mapper, id, &ep, nil, &TransIDLogger{})
+		if errRenderer != nil {
+			render.Render(w, r, errRenderer)
+			return
+		}
+
+		versions, err := datamapper.ReadVersions(db.Shared(), typeString, id)
+		if err != nil {
+			render.Render(w, r, webrender.NewErrDBError(err))
+			return
+		}
+
+		arr := make([]string, len(versions))
+		for i, version := range versions {
+			content := []byte("null")
+			if version.Model != nil {
+				if content, err = tools.ToJSON(version.Model, data.Roles[0], ep.Who); err != nil {
+					render.Render(w, r, webrender.NewErrGenJSON(err))
+					return
+				}
+			}
+
+			userID := "null"
+			if version.UserID != nil {
+				userID = strconv.Quote(version.UserID.String())
+			}
+
+			arr[i] = fmt.Sprintf(`{ "at": %s, "op": %d, "userId": %s, "content": %s }`,
+				strconv.Quote(version.At.Format(time.RFC3339Nano)), version.Op, userID, string(content))
+		}
+
+		bytes := []byte(fmt.Sprintf(`{ "code": 0, "content": [%s] }`, strings.Join(arr, ",")))
+		c.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		c.Writer.Header().Set("Cache-Control", "no-store")
+		c.Writer.Header().Set("Content-Length", strconv.Itoa(len(bytes)))
+		c.Writer.Write(bytes)
+	}
+}
+
 // UpdateManyHandler returns a Gin handler which updates many records
 func UpdateManyHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
 	return func(c *gin.Context) {
@@ -483,6 +887,17 @@ func UpdateManyHandler(typeString string, mapper datamapper.IDataMapper) func(c
 			return
 		}
 
+		if registry.ModelRegistry[typeString].Upsert {
+			data, handlerFetchers, errRenderer := lifecycle.UpsertMany(db.Shared(), mapper, modelObjs, &ep, nil, &TransIDLogger{})
+			if errRenderer != nil {
+				render.Render(w, r, errRenderer)
+				return
+			}
+
+			renderUpsert(c, data, &ep, handlerFetchers, func() { RenderJSONForModelSlice(c, data, &ep, nil) })
+			return
+		}
+
 		data, handlerFetcher, errRenderer := lifecycle.UpdateMany(db.Shared(), mapper, modelObjs, &ep, nil, &TransIDLogger{})
 		if errRenderer != nil {
 			render.Render(w, r, errRenderer)
@@ -520,6 +935,24 @@ func UpdateOneHandler(typeString string, mapper datamapper.IDataMapper) func(c *
 			return
 		}
 
+		if registry.ModelRegistry[typeString].Upsert {
+			if modelObj.GetID() == nil {
+				modelObj.SetID(id)
+			} else if modelObj.GetID().String() != id.String() {
+				render.Render(w, r, webrender.NewErrValidation(fmt.Errorf("id in JSON doesn't match the URL")))
+				return
+			}
+
+			data, handlerFetchers, errRenderer := lifecycle.UpsertOne(db.Shared(), mapper, modelObj, &ep, nil, &TransIDLogger{})
+			if errRenderer != nil {
+				render.Render(w, r, errRenderer)
+				return
+			}
+
+			renderUpsert(c, data, &ep, handlerFetchers, func() { RenderJSONForModel(c, data.Ms[0], data, &ep) })
+			return
+		}
+
 		// Before validation this is a temporary check
 		// This traps the mistake if "content" and the array is included
 		if modelObj.GetID() == nil {
@@ -680,3 +1113,65 @@ func DeleteOneHandler(typeString string, mapper datamapper.IDataMapper) func(c *
 		}
 	}
 }
+
+// RestoreOneHandler un-deletes a soft-deleted record
+func RestoreOneHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		w, r := c.Writer, c.Request
+
+		id, httperr := IDFromURLQueryString(c)
+		if httperr != nil {
+			render.Render(w, r, httperr)
+			return
+		}
+
+		ep := hook.EndPoint{
+			URL:         c.Request.URL.String(),
+			Op:          rest.OpRestore,
+			Cardinality: rest.CardinalityOne,
+			TypeString:  typeString,
+			URLParams:   OptionFromContext(r),
+			Who:         WhoFromContext(r),
+		}
+
+		data, handlerFetcher, errRenderer := lifecycle.RestoreOne(db.Shared(), mapper, id, &ep, nil, &TransIDLogger{})
+		if errRenderer != nil {
+			render.Render(w, r, errRenderer)
+			return
+		}
+
+		RenderModel(c, data, &ep, nil, handlerFetcher)
+	}
+}
+
+// PurgeOneHandler hard-deletes a soft-deleted record
+func PurgeOneHandler(typeString string, mapper datamapper.IDataMapper) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		w, r := c.Writer, c.Request
+
+		id, httperr := IDFromURLQueryString(c)
+		if httperr != nil {
+			render.Render(w, r, httperr)
+			return
+		}
+
+		ep := hook.EndPoint{
+			URL:         c.Request.URL.String(),
+			Op:          rest.OpPurge,
+			Cardinality: rest.CardinalityOne,
+			TypeString:  typeString,
+			URLParams:   OptionFromContext(r),
+			Who:         WhoFromContext(r),
+		}
+
+		data, handlerFetcher, errRenderer := lifecycle.PurgeOne(db.Shared(), mapper, id, &ep, nil, &TransIDLogger{})
+		if errRenderer != nil {
+			render.Render(w, r, errRenderer)
+			return
+		}
+
+		if !CustomRender(c, data, &ep, nil, handlerFetcher) {
+			RenderCodeAndMsg(c, 0, 1, nil, nil)
+		}
+	}
+}